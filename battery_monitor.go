@@ -8,11 +8,11 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
-	"os/user"
+	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/nicois/battery_monitor/ntfy"
 	"github.com/nicois/battery_monitor/power_sources"
 
@@ -42,32 +42,299 @@ func initLogger(_ context.Context) {
 
 type Alerter interface {
 	Alerted(power_sources.Status)
-	ShouldAlert(*zap.Logger, *power_sources.Status) (bool, string)
+	Evaluate(*zap.Logger, *power_sources.Status) (power_sources.Alert, bool)
 }
 
 type Sender interface {
 	Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error
 }
 
-func monitor[P power_sources.PowerSource](ctx context.Context, p P, once bool) {
-	ticker := time.NewTicker(time.Minute)
-	haToken := os.Getenv("HA_REST_API_TOKEN")
-	sensor := os.Getenv("HA_SENSOR")
-	ha := NewHomeAssistantRestApi("https://qck.duckdns.org", haToken)
+// Flusher is implemented by senders which keep messages
+// they could not deliver, to try again later.
+type Flusher interface {
+	Flush(ctx context.Context, logger *zap.Logger) error
+}
+
+// battery summarises the status for senders, or returns nil if there is none.
+func battery(status *power_sources.Status) *ntfy.Battery {
+	if status == nil {
+		return nil
+	}
+	result := &ntfy.Battery{
+		Summary: status.String(),
+		Charge:  status.Charge(),
+		State:   status.State(),
+		Time:    status.Time(),
+	}
+	if remaining, ok := status.TimeToEmpty(); ok {
+		result.TimeToEmpty = &remaining
+	}
+	if remaining, ok := status.TimeToFull(); ok {
+		result.TimeToFull = &remaining
+	}
+	return result
+}
+
+// send delivers an alert about the status. It returns true if the
+// alert was accepted, even if only by some senders, or to be
+// delivered later.
+func send(ctx context.Context, sender Sender, a power_sources.Alert, status *power_sources.Status) bool {
+	message := ntfy.Message{
+		Text:     a.Message,
+		Title:    a.Title,
+		Priority: a.Priority,
+		Tags:     a.Tags,
+		Battery:  battery(status),
+	}
+	if err := sender.Send(ctx, logger, message); errors.Is(err, ErrPartiallySent) {
+		// retrying would repeat the alert to the senders which succeeded
+		logger.Warn("Alert was not sent everywhere", zap.Error(err))
+	} else if errors.Is(err, ntfy.ErrQueued) {
+		logger.Info("Alert will be sent later", zap.Error(err))
+	} else if err != nil {
+		logger.Warn("While sending alert", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// alert consults the alerter and, if it decides the new status is
+// worth reporting, sends it. The alerter is only told about the status
+// once the message has been delivered (or queued for later delivery),
+// so a failed send is retried on the next tick. It returns true if an
+// alert was sent.
+func alert(ctx context.Context, alerter Alerter, sender Sender, status *power_sources.Status) bool {
+	a, shouldAlert := alerter.Evaluate(logger, status)
+	if !shouldAlert || !send(ctx, sender, a, status) {
+		return false
+	}
+	alerter.Alerted(*status)
+	return true
+}
+
+func updateNumeric(ctx context.Context, ha *HaRestApi, sensor string, value float32, attributes HaAttributes, precision int) {
+	if err := ha.UpdateNumericStateWithAttributes(ctx, sensor, value, attributes, precision); err != nil {
+		logger.Warn("While publishing", zap.String("sensor", sensor), zap.Error(err))
+	}
+}
+
+// publishStatus sends the charge to Home Assistant, along with
+// any telemetry which is available, each to its own sensor
+// named with a suffix (e.g. sensor.laptop_battery_power).
+func publishStatus(ctx context.Context, ha *HaRestApi, sensor string, status *power_sources.Status) {
+	t := status.Telemetry()
+	updateNumeric(ctx, ha, sensor, float32(100*status.Charge()), HaAttributes{
+		UnitOfMeasurement: "%",
+		Manufacturer:      t.Manufacturer,
+		Model:             t.Model,
+		Technology:        t.Technology,
+	}, 2)
+	for _, reading := range []struct {
+		suffix    string
+		value     *float64
+		scale     float64
+		unit      string
+		precision int
+	}{
+		{"_power", t.Power, 1, "W", 1},
+		{"_voltage", t.Voltage, 1, "V", 2},
+		{"_temperature", t.Temperature, 1, "°C", 1},
+		{"_health", t.Health, 100, "%", 1},
+	} {
+		if reading.value != nil {
+			updateNumeric(ctx, ha, sensor+reading.suffix, float32(*reading.value*reading.scale), HaAttributes{UnitOfMeasurement: reading.unit}, reading.precision)
+		}
+	}
+	if t.CycleCount != nil {
+		updateNumeric(ctx, ha, sensor+"_cycle_count", float32(*t.CycleCount), HaAttributes{}, 0)
+	}
+	if t.CapacityLevel != "" {
+		if err := ha.UpdateState(ctx, sensor+"_capacity_level", HaRestMessage{State: t.CapacityLevel}); err != nil {
+			logger.Warn("While publishing", zap.String("sensor", sensor+"_capacity_level"), zap.Error(err))
+		}
+	}
+}
+
+// publish sends the status to Home Assistant. When the status combines
+// several batteries, each of them is also sent to its own sensors,
+// named after the battery (e.g. sensor.laptop_battery_bat0).
+func publish(ctx context.Context, ha *HaRestApi, sensor string, status *power_sources.Status) {
+	publishStatus(ctx, ha, sensor, status)
+	for suffix, estimate := range map[string]func() (time.Duration, bool){
+		"_time_to_empty": status.TimeToEmpty,
+		"_time_to_full":  status.TimeToFull,
+	} {
+		if remaining, ok := estimate(); ok {
+			updateNumeric(ctx, ha, sensor+suffix, float32(remaining.Minutes()), HaAttributes{UnitOfMeasurement: "min", DeviceClass: "duration"}, 0)
+		} else if err := ha.UpdateState(ctx, sensor+suffix, HaRestMessage{State: "unknown"}); err != nil {
+			logger.Warn("While publishing", zap.String("sensor", sensor+suffix), zap.Error(err))
+		}
+	}
+	for _, part := range status.Parts() {
+		publishStatus(ctx, ha, sensor+"_"+strings.ToLower(part.Name()), &part)
+	}
+	for _, adapter := range status.Adapters() {
+		publishAdapter(ctx, ha, sensor, adapter)
+	}
+	for _, peripheral := range status.Peripherals() {
+		publishPeripheral(ctx, ha, peripheral)
+	}
+}
+
+// publishPeripheral sends a device's battery to its own sensor,
+// named after the device (e.g. sensor.mx_master_3_battery).
+func publishPeripheral(ctx context.Context, ha *HaRestApi, peripheral power_sources.Peripheral) {
+	sensor := peripheralSensor(peripheral)
+	attributes := HaAttributes{
+		FriendlyName: peripheral.Label() + " battery",
+		Manufacturer: peripheral.Manufacturer,
+		Model:        peripheral.Model,
+	}
+	if peripheral.Charge != nil {
+		attributes.DeviceClass = "battery"
+		attributes.UnitOfMeasurement = "%"
+		updateNumeric(ctx, ha, sensor, float32(100**peripheral.Charge), attributes, 0)
+	} else if err := ha.UpdateState(ctx, sensor, HaRestMessage{State: peripheral.CapacityLevel, Attributes: attributes}); err != nil {
+		logger.Warn("While publishing", zap.String("sensor", sensor), zap.Error(err))
+	}
+}
+
+func monitor[P power_sources.PowerSource](ctx context.Context, config Config, p P, sender Sender, once bool) {
+	ticker := time.NewTicker(config.PollInterval)
+	defer ticker.Stop()
+	var ha *HaRestApi
+	sensor := config.HomeAssistant.Sensor
+	if sensor != "" {
+		ha = NewHomeAssistantRestApi(
+			config.HomeAssistant.Server,
+			config.HomeAssistant.Token,
+			WithTolerance(sensor, config.HomeAssistant.Tolerance),
+		)
+	}
+	// travel mode can only have been turned on if there is charge control
+	control, _ := chargeControl(p)
+	travelFilename := config.State.travelFilename()
+	var peripheralWatch *PeripheralWatch
+	if config.Peripherals.Low > 0 {
+		peripheralWatch = NewPeripheralWatch(config.Peripherals)
+	}
+	var chargerWatch *ChargerWatch
+	if config.Charger.Grace > 0 {
+		chargerWatch = NewChargerWatch(config.Charger)
+	}
+	var limiter *ChargeLimiter
+	if config.ChargeLimit.Enabled() {
+		limiter = NewChargeLimiter(Must(config.NewChargerSwitch()), config.ChargeLimit)
+	}
+	// refresh is signalled when Home Assistant wants to know the status now
+	refresh := make(chan struct{}, 1)
+	requestRefresh := func() {
+		select {
+		case refresh <- struct{}{}:
+		default:
+		}
+	}
+	if ha != nil && config.HomeAssistant.WebSocket {
+		ws := Must(NewHaWebSocket(config.HomeAssistant.Server, config.HomeAssistant.Token, WithOnConnect(requestRefresh)))
+		if entity := config.HomeAssistant.RefreshEntity; entity != "" {
+			Must0(ws.SubscribeStateChanges(ctx, func(HaStateChange) { requestRefresh() }, entity))
+		}
+		go ws.Run(ctx)
+	}
+	var haMqtt *HaMqtt
+	if config.Mqtt.Broker != "" {
+		haMqtt = Must(NewHaMqtt(config.Mqtt))
+		defer haMqtt.Close()
+	}
+	store := NewStateStore(config.State)
+	state, err := store.Load()
+	if err != nil {
+		logger.Warn("While loading state", zap.Error(err))
+	}
+	if ha != nil && state.HomeAssistant != nil {
+		ha.Restore(*state.HomeAssistant)
+	}
+	estimator := power_sources.NewEstimator(config.EstimateWindow)
+	var alerter Alerter
+	if state.LastAlerted != nil {
+		// carry on from where the previous run left off
+		alerter = Must(config.NewAlerter(*state.LastAlerted))
+	}
 	for {
 		status, err := p.GetStatus(ctx)
 		if err != nil {
 			logger.Warn("While getting charge", zap.Error(err))
-			time.Sleep(time.Minute * 10)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(config.RetryInterval):
+			}
 			continue
 		}
-		ha.UpdateNumericState(
-			ctx,
-			sensor,
-			float32(100*status.Charge()),
-			"%",
-			2,
-		)
+		estimator.Add(status)
+		if flusher, ok := sender.(Flusher); ok {
+			// an unresponsive server must not hold up polling
+			flushCtx, cancel := context.WithTimeout(ctx, config.PollInterval)
+			err := flusher.Flush(flushCtx, logger)
+			cancel()
+			if err != nil {
+				logger.Info("Could not send queued messages yet", zap.Error(err))
+			}
+		}
+		if ha != nil {
+			publish(ctx, ha, sensor, status)
+		}
+		if haMqtt != nil {
+			if err := haMqtt.Publish(status); err != nil {
+				logger.Warn("While publishing to MQTT", zap.Error(err))
+			}
+		}
+		if control != nil {
+			if travel, err := finishTravel(control, travelFilename, status); err != nil {
+				logger.Warn("While finishing travel mode", zap.Error(err))
+			} else if travel != nil {
+				logger.Info("Finished travel mode", zap.Object("restored", travel.Restore))
+				send(ctx, sender, power_sources.Alert{
+					Rule:     "travel",
+					Priority: "low",
+					Title:    "Travel charge complete",
+					Message:  fmt.Sprintf("%v; charge thresholds restored to %v", status, travel.Restore),
+					Tags:     []string{"airplane"},
+				}, status)
+			}
+		}
+		if peripheralWatch != nil {
+			for _, a := range peripheralWatch.Update(status) {
+				// the alert is not about the status' battery
+				if send(ctx, sender, a.Alert, nil) {
+					peripheralWatch.Alerted(a.Label)
+				}
+			}
+		}
+		if chargerWatch != nil {
+			if a, shouldAlert := chargerWatch.Update(status); shouldAlert && send(ctx, sender, a, status) {
+				chargerWatch.Alerted()
+			}
+		}
+		if limiter != nil {
+			if a, shouldAlert := limiter.Update(ctx, logger, status); shouldAlert && send(ctx, sender, a, status) {
+				limiter.Alerted()
+			}
+		}
+		if alerter == nil {
+			// the first status is the baseline which later ones are compared to
+			alerter = Must(config.NewAlerter(*status))
+			state.LastAlerted = status
+		} else if alert(ctx, alerter, sender, status) {
+			state.LastAlerted = status
+		}
+		if ha != nil {
+			snapshot := ha.Snapshot()
+			state.HomeAssistant = &snapshot
+		}
+		if err := store.Save(state); err != nil {
+			logger.Warn("While saving state", zap.Error(err))
+		}
 		if once {
 			return
 		}
@@ -76,37 +343,34 @@ func monitor[P power_sources.PowerSource](ctx context.Context, p P, once bool) {
 			return
 		case <-ticker.C:
 			break
-
+		case <-refresh:
+			// Home Assistant may have restarted, losing the sensors
+			ha.Forget()
 		}
 	}
 }
 
-type Config struct {
-	Topic string
-}
-
-func get_config() Config {
-	usr, _ := user.Current()
-	dir := usr.HomeDir
-	filename := dir + "/.config/battery_monitor.toml"
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		panic(err)
-	}
-	config := Config{}
-	_, err = toml.Decode(string(data), &config)
-	if err != nil {
-		panic(err)
-	}
-	if len(config.Topic) < 1 {
-		panic("you have not defined a topic")
-	}
-	return config
-}
-
 func main() {
-	ctx := context.Background()
+	// stopping cleanly lets MQTT sensors be marked unavailable
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	var once = flag.Bool("once", false, "only run a single time")
+	var configFilename = flag.String("config", defaultConfigFilename(), "TOML configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage: %v [flags] [command]
+
+Without a command, the battery is monitored. Commands:
+  set-thresholds [START] END  set the firmware's charge thresholds, as percentages
+  travel                      charge to 100%%, then restore the thresholds
+
+Setting thresholds needs write access to them, e.g. through a udev rule.
+travel can't be run with sudo, as the monitor must be able to find and
+remove what it records in the state directory.
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	initLogger(ctx)
@@ -119,6 +383,22 @@ func main() {
 		}
 	}()
 
-	battery := power_sources.NewBattery()
-	monitor(ctx, battery, *once)
+	switch command := flag.Arg(0); command {
+	case "":
+		config := Must(get_config(*configFilename))
+		sender := Must(config.NewSender())
+		battery := power_sources.WithPeripherals(power_sources.WithAdapters(power_sources.NewBattery()), config.Peripherals.Options()...)
+		monitor(ctx, config, battery, sender, *once)
+	case "set-thresholds":
+		thresholds := Must(parseThresholds(flag.Args()[1:]))
+		Must0(Must(chargeControl(power_sources.NewBattery())).SetChargeThresholds(thresholds))
+		logger.Info("Set charge thresholds", zap.Object("thresholds", thresholds))
+	case "travel":
+		Must0(checkNotSudo())
+		state := Must(get_state_config(*configFilename))
+		Must0(startTravel(Must(chargeControl(power_sources.NewBattery())), state.travelFilename()))
+		logger.Info("Charging to 100% until the battery is full")
+	default:
+		logger.Fatal("Unknown command; expected set-thresholds or travel", zap.String("command", command))
+	}
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/power_sources"
+	"github.com/nicois/battery_monitor/shelly"
+	"github.com/nicois/battery_monitor/tasmota"
+	"go.uber.org/zap"
+)
+
+// ChargeLimitConfig keeps the charge between two bounds by switching
+// the charger's smart plug, for machines whose firmware can't. The
+// plug is either controlled through Home Assistant, or directly.
+type ChargeLimitConfig struct {
+	Plug     string        `toml:"plug"`    // Home Assistant entity the charger is plugged into, e.g. switch.laptop_charger
+	Shelly   string        `toml:"shelly"`  // or the address of a Shelly plug, e.g. http://192.168.1.50
+	Tasmota  string        `toml:"tasmota"` // or the address of a Tasmota plug
+	Relay    int           `toml:"relay"`   // for Shelly or Tasmota devices with several relays
+	Username string        `toml:"username"`
+	Password string        `toml:"password"`
+	Upper    float64       `toml:"upper"`  // turn the plug off once the charge reaches this
+	Lower    float64       `toml:"lower"`  // turn it back on once the charge falls to this
+	Verify   time.Duration `toml:"verify"` // how long the plug may take to report its new state
+	Settle   time.Duration `toml:"settle"` // how long the battery may take to start or stop charging
+}
+
+func DefaultChargeLimitConfig() ChargeLimitConfig {
+	return ChargeLimitConfig{
+		Upper:  0.8,
+		Lower:  0.4,
+		Verify: 10 * time.Second,
+		Settle: 5 * time.Minute,
+	}
+}
+
+// Enabled is true if a plug has been configured.
+func (c *ChargeLimitConfig) Enabled() bool {
+	return c.Plug != "" || c.Shelly != "" || c.Tasmota != ""
+}
+
+func (c *ChargeLimitConfig) Validate() error {
+	configured := 0
+	for _, plug := range []string{c.Plug, c.Shelly, c.Tasmota} {
+		if plug != "" {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return fmt.Errorf("plug: only one of plug, shelly and tasmota may be set")
+	}
+	if _, _, found := strings.Cut(c.Plug, "."); c.Plug != "" && !found {
+		return fmt.Errorf("plug: %q should be an entity id, e.g. switch.laptop_charger", c.Plug)
+	}
+	if c.Relay < 0 {
+		return fmt.Errorf("relay: %v must not be negative", c.Relay)
+	}
+	if c.Lower < 0 || c.Upper > 1 || c.Lower >= c.Upper {
+		return fmt.Errorf("lower: %v must be less than upper (%v), and both between 0 and 1", c.Lower, c.Upper)
+	}
+	if c.Verify <= 0 {
+		return fmt.Errorf("verify: %v must be positive", c.Verify)
+	}
+	if c.Settle <= 0 {
+		return fmt.Errorf("settle: %v must be positive", c.Settle)
+	}
+	return nil
+}
+
+// ChargerSwitch turns the charger on and off.
+type ChargerSwitch interface {
+	Set(ctx context.Context, on bool) error
+	IsOn(ctx context.Context) (bool, error)
+	String() string
+}
+
+// NewChargerSwitch returns whichever kind of plug is configured.
+func (c *Config) NewChargerSwitch() (ChargerSwitch, error) {
+	limit := c.ChargeLimit
+	switch {
+	case limit.Shelly != "":
+		options := []shelly.Option{shelly.WithRelay(limit.Relay)}
+		if limit.Username != "" {
+			options = append(options, shelly.WithAuth(limit.Username, limit.Password))
+		}
+		return shelly.Create(limit.Shelly, options...)
+	case limit.Tasmota != "":
+		var options []tasmota.Option
+		if limit.Relay > 0 {
+			options = append(options, tasmota.WithRelay(limit.Relay))
+		}
+		if limit.Username != "" {
+			options = append(options, tasmota.WithAuth(limit.Username, limit.Password))
+		}
+		return tasmota.Create(limit.Tasmota, options...)
+	case limit.Plug != "":
+		api := NewHomeAssistantRestApi(c.HomeAssistant.Server, c.HomeAssistant.Token)
+		return NewHaSwitch(api, limit.Plug), nil
+	}
+	return nil, fmt.Errorf("charge_limit: no plug is configured")
+}
+
+// HaSwitch is a switch (or anything else with turn_on and
+// turn_off services) controlled through Home Assistant.
+type HaSwitch struct {
+	ha     *HaRestApi
+	entity string
+}
+
+func NewHaSwitch(ha *HaRestApi, entity string) *HaSwitch {
+	return &HaSwitch{ha: ha, entity: entity}
+}
+
+func (s *HaSwitch) String() string {
+	return s.entity
+}
+
+func (s *HaSwitch) Set(ctx context.Context, on bool) error {
+	domain, _, _ := strings.Cut(s.entity, ".")
+	service := "turn_off"
+	if on {
+		service = "turn_on"
+	}
+	return s.ha.CallService(ctx, domain, service, map[string]string{"entity_id": s.entity})
+}
+
+func (s *HaSwitch) IsOn(ctx context.Context) (bool, error) {
+	state, err := s.ha.GetState(ctx, s.entity)
+	if err != nil {
+		return false, err
+	}
+	switch state.State {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%v is %q", s.entity, state.State)
+}
+
+// ChargeLimiter turns the charger off once the battery reaches the
+// upper bound, and on again once it falls to the lower bound. It checks
+// both that the plug switched, and that the battery followed suit.
+type ChargeLimiter struct {
+	plug   ChargerSwitch
+	config ChargeLimitConfig
+
+	on         *bool     // what the plug was last switched to, if known
+	switchedAt time.Time // when that happened; zero once the battery has been checked
+	failing    bool      // whether the plug's failure has been alerted
+	pending    func()    // records that the alert last returned was delivered
+}
+
+func NewChargeLimiter(plug ChargerSwitch, config ChargeLimitConfig) *ChargeLimiter {
+	return &ChargeLimiter{plug: plug, config: config}
+}
+
+// verify waits for the plug to report the expected state.
+func (l *ChargeLimiter) verify(ctx context.Context, on bool) error {
+	deadline := time.Now().Add(l.config.Verify)
+	for {
+		isOn, err := l.plug.IsOn(ctx)
+		if err == nil && isOn == on {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%v is still %v", l.plug, onOff(isOn))
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// switchPlug returns an alert if the plug could not be switched.
+// Once it has been alerted, it is only alerted again after
+// the plug has been switched successfully.
+func (l *ChargeLimiter) switchPlug(ctx context.Context, logger *zap.Logger, on bool, status *power_sources.Status) (power_sources.Alert, bool) {
+	logger.Info("Switching charger", zap.String("plug", l.plug.String()), zap.Bool("on", on), zap.Float64("charge", status.Charge()))
+	err := l.plug.Set(ctx, on)
+	if err == nil {
+		err = l.verify(ctx, on)
+	}
+	if err != nil {
+		logger.Warn("While switching charger", zap.String("plug", l.plug.String()), zap.Error(err))
+		if l.failing {
+			return power_sources.Alert{}, false
+		}
+		l.pending = func() { l.failing = true }
+		return power_sources.Alert{
+			Rule:     "charge-limit",
+			Priority: "high",
+			Title:    "Charger plug is not responding",
+			Message:  fmt.Sprintf("Could not turn %v %v at %v: %v", l.plug, onOff(on), status, err),
+			Tags:     []string{"electric_plug", "warning"},
+		}, true
+	}
+	l.on = &on
+	l.switchedAt = status.Time()
+	l.failing = false
+	return power_sources.Alert{}, false
+}
+
+// Update switches the plug if the charge has reached either bound,
+// returning an alert if this fails, or if the machine doesn't switch
+// between external power and its battery as a result. Until the
+// alert is marked as Alerted, it will be returned again.
+func (l *ChargeLimiter) Update(ctx context.Context, logger *zap.Logger, status *power_sources.Status) (power_sources.Alert, bool) {
+	l.pending = nil
+	charge := status.Charge()
+	if charge >= l.config.Upper && (l.on == nil || *l.on) {
+		return l.switchPlug(ctx, logger, false, status)
+	}
+	if charge <= l.config.Lower && (l.on == nil || !*l.on) {
+		return l.switchPlug(ctx, logger, true, status)
+	}
+	if l.on == nil || l.switchedAt.IsZero() || status.Time().Sub(l.switchedAt) < l.config.Settle {
+		return power_sources.Alert{}, false
+	}
+	if (*l.on && status.ExternalPower()) || (!*l.on && status.Discharging()) {
+		l.switchedAt = time.Time{}
+		return power_sources.Alert{}, false
+	}
+	l.pending = func() { l.switchedAt = time.Time{} }
+	expected := "switched to its battery"
+	if *l.on {
+		expected = "switched to external power"
+	}
+	return power_sources.Alert{
+		Rule:     "charge-limit",
+		Priority: "high",
+		Title:    "Battery is not following the charger plug",
+		Message:  fmt.Sprintf("%v was turned %v, but the machine has not %v: %v", l.plug, onOff(*l.on), expected, status),
+		Tags:     []string{"electric_plug", "warning"},
+	}, true
+}
+
+// Alerted records that the alert returned by Update was delivered.
+func (l *ChargeLimiter) Alerted() {
+	if l.pending != nil {
+		l.pending()
+		l.pending = nil
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nicois/battery_monitor/power_sources"
+	"go.uber.org/zap"
+)
+
+// brokenPlug is a plug which can't be switched.
+type brokenPlug struct{}
+
+func (brokenPlug) Set(context.Context, bool) error    { return errors.New("no route to host") }
+func (brokenPlug) IsOn(context.Context) (bool, error) { return false, errors.New("no route to host") }
+func (brokenPlug) String() string                     { return "switch.laptop_charger" }
+
+func testStatus(t *testing.T, charge float64, state string) *power_sources.Status {
+	var status power_sources.Status
+	data, _ := json.Marshal(map[string]any{"charge": charge, "state": state, "timestamp": time.Now()})
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	return &status
+}
+
+func TestChargeLimiterRetriesUndeliveredAlert(t *testing.T) {
+	limiter := NewChargeLimiter(brokenPlug{}, DefaultChargeLimitConfig())
+	status := testStatus(t, 0.9, "Charging")
+	ctx := context.Background()
+
+	if _, shouldAlert := limiter.Update(ctx, zap.NewNop(), status); !shouldAlert {
+		t.Fatal("expected an alert when the plug can't be switched")
+	}
+	// the alert was not delivered, so it is raised again
+	if _, shouldAlert := limiter.Update(ctx, zap.NewNop(), status); !shouldAlert {
+		t.Fatal("expected the undelivered alert to be raised again")
+	}
+	limiter.Alerted()
+	if _, shouldAlert := limiter.Update(ctx, zap.NewNop(), status); shouldAlert {
+		t.Error("expected no further alert once it was delivered")
+	}
+}
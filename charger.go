@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/power_sources"
+	"go.uber.org/zap"
+)
+
+type ChargerConfig struct {
+	// how long the battery may keep discharging with a charger
+	// connected before alerting; zero to never alert
+	Grace    time.Duration `toml:"grace"`
+	Priority string        `toml:"priority"`
+}
+
+func DefaultChargerConfig() ChargerConfig {
+	return ChargerConfig{Grace: 5 * time.Minute, Priority: "default"}
+}
+
+func (c *ChargerConfig) Validate() error {
+	if c.Grace < 0 {
+		return fmt.Errorf("grace: %v must not be negative", c.Grace)
+	}
+	if !slices.Contains(power_sources.Priorities, c.Priority) {
+		return fmt.Errorf("priority: %q is not one of %v", c.Priority, power_sources.Priorities)
+	}
+	return nil
+}
+
+// ChargerWatch alerts when a charger is connected but the battery is
+// still discharging, as happens with a low-wattage USB-C charger
+// under load. It alerts once each time a charger is connected, with
+// the alert returned by Update until it is marked as Alerted.
+type ChargerWatch struct {
+	config  ChargerConfig
+	since   time.Time // when the battery started discharging with a charger connected
+	alerted bool
+}
+
+func NewChargerWatch(config ChargerConfig) *ChargerWatch {
+	return &ChargerWatch{config: config}
+}
+
+func describeAdapter(adapter power_sources.Adapter) string {
+	var details []string
+	if adapter.USBType != "" {
+		details = append(details, adapter.USBType)
+	}
+	if adapter.MaxPower != nil {
+		details = append(details, fmt.Sprintf("%.0fW max", *adapter.MaxPower))
+	}
+	if len(details) == 0 {
+		return adapter.Name
+	}
+	return fmt.Sprintf("%v (%v)", adapter.Name, strings.Join(details, ", "))
+}
+
+func (w *ChargerWatch) Update(status *power_sources.Status) (power_sources.Alert, bool) {
+	online := status.OnlineAdapters()
+	if len(online) == 0 {
+		w.since, w.alerted = time.Time{}, false
+		return power_sources.Alert{}, false
+	}
+	if !status.Discharging() {
+		w.since = time.Time{}
+		return power_sources.Alert{}, false
+	}
+	if w.since.IsZero() {
+		w.since = status.Time()
+	}
+	if w.alerted || status.Time().Sub(w.since) < w.config.Grace {
+		return power_sources.Alert{}, false
+	}
+	names := make([]string, len(online))
+	for i, adapter := range online {
+		names[i] = describeAdapter(adapter)
+	}
+	message := fmt.Sprintf("%v is connected, but the battery is discharging", strings.Join(names, " and "))
+	if power := status.Telemetry().Power; power != nil {
+		message += fmt.Sprintf(" at %.1fW", *power)
+	}
+	message += ": " + status.String()
+	if remaining, ok := status.TimeToEmpty(); ok {
+		message += fmt.Sprintf(", %v remaining", power_sources.FormatDuration(remaining))
+	}
+	return power_sources.Alert{
+		Rule:     "weak-charger",
+		Priority: w.config.Priority,
+		Title:    "Charger cannot keep up",
+		Message:  message,
+		Tags:     []string{"electric_plug", "warning"},
+	}, true
+}
+
+// Alerted records that the alert returned by Update was delivered.
+func (w *ChargerWatch) Alerted() {
+	w.alerted = true
+}
+
+// adapterSensor is the Home Assistant entity showing whether an
+// adapter is connected, named after the battery's sensor
+// (e.g. binary_sensor.laptop_battery_ac).
+func adapterSensor(sensor string, adapter power_sources.Adapter) string {
+	return "binary_sensor." + strings.TrimPrefix(sensor, "sensor.") + "_" + entitySlug(adapter.Name)
+}
+
+// publishAdapter sends whether the adapter is connected and, if
+// known, the most power it offers (e.g. sensor.laptop_battery_ac_max_power).
+func publishAdapter(ctx context.Context, ha *HaRestApi, sensor string, adapter power_sources.Adapter) {
+	online := adapterSensor(sensor, adapter)
+	state := "off"
+	if adapter.Online {
+		state = "on"
+	}
+	message := HaRestMessage{State: state, Attributes: HaAttributes{FriendlyName: adapter.Name, DeviceClass: "plug"}}
+	if err := ha.UpdateState(ctx, online, message); err != nil {
+		logger.Warn("While publishing", zap.String("sensor", online), zap.Error(err))
+	}
+	if adapter.MaxPower != nil {
+		updateNumeric(ctx, ha, sensor+"_"+entitySlug(adapter.Name)+"_max_power", float32(*adapter.MaxPower), HaAttributes{
+			FriendlyName:      adapter.Name + " max power",
+			DeviceClass:       "power",
+			UnitOfMeasurement: "W",
+		}, 0)
+	}
+}
@@ -0,0 +1,136 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+// Alert is what the command receives as JSON on its standard input.
+type Alert struct {
+	Message     string   `json:"message"`
+	Title       string   `json:"title,omitempty"`
+	Priority    string   `json:"priority"`
+	Tags        []string `json:"tags,omitempty"`
+	Charge      *float64 `json:"charge,omitempty"` // percent
+	State       string   `json:"state,omitempty"`
+	TimeToEmpty *float64 `json:"time_to_empty,omitempty"` // minutes
+	TimeToFull  *float64 `json:"time_to_full,omitempty"`  // minutes
+}
+
+func newAlert(message ntfy.Message) Alert {
+	result := Alert{
+		Message:  message.Text,
+		Title:    message.Title,
+		Priority: message.Priority,
+		Tags:     message.Tags,
+	}
+	if battery := message.Battery; battery != nil {
+		charge := battery.Charge * 100
+		result.Charge = &charge
+		result.State = battery.State
+		if remaining := battery.TimeToEmpty; remaining != nil {
+			minutes := remaining.Minutes()
+			result.TimeToEmpty = &minutes
+		}
+		if remaining := battery.TimeToFull; remaining != nil {
+			minutes := remaining.Minutes()
+			result.TimeToFull = &minutes
+		}
+	}
+	return result
+}
+
+// Environ returns the alert as environment variables, such as
+// BATTERY_CHARGE=35 and ALERT_PRIORITY=high. Values which are not
+// known are left out.
+func (a Alert) Environ() []string {
+	result := []string{
+		"ALERT_MESSAGE=" + a.Message,
+		"ALERT_TITLE=" + a.Title,
+		"ALERT_PRIORITY=" + a.Priority,
+		"ALERT_TAGS=" + strings.Join(a.Tags, ","),
+	}
+	if a.State != "" {
+		result = append(result, "BATTERY_STATE="+a.State)
+	}
+	for name, value := range map[string]*float64{
+		"BATTERY_CHARGE":        a.Charge,
+		"BATTERY_TIME_TO_EMPTY": a.TimeToEmpty,
+		"BATTERY_TIME_TO_FULL":  a.TimeToFull,
+	} {
+		if value != nil {
+			result = append(result, fmt.Sprintf("%v=%.0f", name, *value))
+		}
+	}
+	return result
+}
+
+type command struct {
+	argv    []string
+	timeout time.Duration
+}
+
+type Option func(c *command) error
+
+// WithTimeout kills the command if it runs for longer than this.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *command) error {
+		c.timeout = timeout
+		return nil
+	}
+}
+
+func (c *command) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	logger.Info("Running command", zap.String("message", message.Text), zap.Strings("command", c.argv))
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	alert := newAlert(message)
+	stdin, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, c.argv[0], c.argv[1:]...)
+	cmd.Env = append(os.Environ(), alert.Environ()...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	err = cmd.Run()
+	if stderr.Len() > 0 {
+		logger.Info("Command wrote to stderr", zap.Strings("command", c.argv), zap.String("stderr", strings.TrimSpace(stderr.String())))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("While running %v: %w", c.argv[0], ctx.Err())
+		}
+		return fmt.Errorf("While running %v: %w", c.argv[0], err)
+	}
+	return nil
+}
+
+// Create returns a sender which runs a command for each alert,
+// passing the details in environment variables and as JSON on
+// its standard input. Exiting with a non-zero status is a failure.
+func Create(argv []string, options ...Option) (*command, error) {
+	if len(argv) == 0 || argv[0] == "" {
+		return nil, fmt.Errorf("command: must not be empty")
+	}
+	result := &command{argv: argv, timeout: 30 * time.Second}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
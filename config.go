@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nicois/battery_monitor/power_sources"
+)
+
+type HomeAssistantConfig struct {
+	Server    string          `toml:"server"`     // e.g. https://homeassistant.local:8123
+	Token     string          `toml:"token"`      // long-lived access token
+	TokenFile string          `toml:"token_file"` // alternatively, a file containing the token
+	Sensor    string          `toml:"sensor"`     // entity id to publish the charge to, e.g. sensor.laptop_battery
+	Tolerance SensorTolerance `toml:"tolerance"`  // don't publish changes smaller than this
+	// WebSocket keeps a connection open, so sensors can be published
+	// again as soon as Home Assistant restarts.
+	WebSocket     bool   `toml:"websocket"`
+	RefreshEntity string `toml:"refresh_entity"` // when this changes (e.g. an input_button is pressed), check the battery straight away
+}
+
+type Config struct {
+	Topic          string                          `toml:"topic"` // deprecated: use ntfy.topic
+	PollInterval   time.Duration                   `toml:"poll_interval"`
+	RetryInterval  time.Duration                   `toml:"retry_interval"`  // how long to wait after failing to read the battery
+	EstimateWindow time.Duration                   `toml:"estimate_window"` // how much history to base time to empty/full on
+	HomeAssistant  HomeAssistantConfig             `toml:"home_assistant"`
+	Mqtt           MqttConfig                      `toml:"mqtt"`   // publish to Home Assistant using MQTT discovery
+	Ntfy           NtfyConfig                      `toml:"ntfy"`   // a single ntfy topic, receiving all alerts
+	Notify         NotifyConfig                    `toml:"notify"` // any number of senders, with routing
+	State          StateConfig                     `toml:"state"`
+	ChargeLimit    ChargeLimitConfig               `toml:"charge_limit"`
+	Charger        ChargerConfig                   `toml:"charger"`     // alerting about chargers which can't keep up
+	Peripherals    PeripheralsConfig               `toml:"peripherals"` // batteries of devices such as mice and headsets
+	Thresholds     power_sources.Thresholds        `toml:"thresholds"`  // used by the default rules
+	Rules          []power_sources.Rule            `toml:"rules"`       // if empty, the default rules are used
+	AlertMode      string                          `toml:"alert_mode"`  // "charge", or "predictive" to alert based on time to empty
+	Predictive     []power_sources.PredictiveLevel `toml:"predictive"`  // if empty, the default levels are used
+}
+
+// NewAlerter creates the configured kind of alerter,
+// comparing new statuses to initialStatus.
+func (c *Config) NewAlerter(initialStatus power_sources.Status) (Alerter, error) {
+	switch c.AlertMode {
+	case "charge":
+		return power_sources.CreateRuleAlerter(initialStatus, c.AlertRules())
+	case "predictive":
+		return power_sources.CreatePredictiveAlerter(initialStatus, c.PredictiveLevels(), c.AlertRules())
+	}
+	return nil, fmt.Errorf("alert_mode: %q is not one of charge, predictive", c.AlertMode)
+}
+
+// AlertRules returns the configured rules, or the
+// default rules if none were configured.
+func (c *Config) AlertRules() []power_sources.Rule {
+	if len(c.Rules) > 0 {
+		return c.Rules
+	}
+	return power_sources.DefaultRules(c.Thresholds)
+}
+
+// PredictiveLevels returns the configured levels, or the
+// default levels if none were configured. The defaults are not
+// part of DefaultConfig, as decoding [[predictive]] tables over
+// them would leave their fields in place.
+func (c *Config) PredictiveLevels() []power_sources.PredictiveLevel {
+	if len(c.Predictive) > 0 {
+		return c.Predictive
+	}
+	return power_sources.DefaultPredictiveLevels()
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PollInterval:   time.Minute,
+		RetryInterval:  10 * time.Minute,
+		EstimateWindow: 20 * time.Minute,
+		State: StateConfig{
+			MaxAge: 24 * time.Hour,
+		},
+		ChargeLimit: DefaultChargeLimitConfig(),
+		Charger:     DefaultChargerConfig(),
+		Peripherals: DefaultPeripheralsConfig(),
+		Thresholds:  power_sources.DefaultThresholds(),
+		AlertMode:   "charge",
+	}
+}
+
+func defaultConfigFilename() string {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return "battery_monitor.toml"
+	}
+	return filepath.Join(dir, ".config", "battery_monitor.toml")
+}
+
+// envOverrides maps environment variables to the configuration
+// value they replace, if set.
+func (c *Config) envOverrides() map[string]*string {
+	return map[string]*string{
+		"HA_SERVER":         &c.HomeAssistant.Server,
+		"HA_REST_API_TOKEN": &c.HomeAssistant.Token,
+		"HA_TOKEN_FILE":     &c.HomeAssistant.TokenFile,
+		"HA_SENSOR":         &c.HomeAssistant.Sensor,
+		"NTFY_SERVER":       &c.Ntfy.Server,
+		"NTFY_TOPIC":        &c.Ntfy.Topic,
+		"NTFY_TOKEN":        &c.Ntfy.Token,
+		"NTFY_USERNAME":     &c.Ntfy.Username,
+		"NTFY_PASSWORD":     &c.Ntfy.Password,
+		"MQTT_BROKER":       &c.Mqtt.Broker,
+		"MQTT_USERNAME":     &c.Mqtt.Username,
+		"MQTT_PASSWORD":     &c.Mqtt.Password,
+	}
+}
+
+func (c *Config) applyEnvironment() error {
+	for name, target := range c.envOverrides() {
+		if value, exists := os.LookupEnv(name); exists {
+			*target = value
+		}
+	}
+	if value, exists := os.LookupEnv("BATTERY_POLL_INTERVAL"); exists {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("BATTERY_POLL_INTERVAL: %w", err)
+		}
+		c.PollInterval = interval
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval: %v must be positive", c.PollInterval)
+	}
+	if c.RetryInterval <= 0 {
+		return fmt.Errorf("retry_interval: %v must be positive", c.RetryInterval)
+	}
+	if c.EstimateWindow <= 0 {
+		return fmt.Errorf("estimate_window: %v must be positive", c.EstimateWindow)
+	}
+	if c.State.MaxAge <= 0 {
+		return fmt.Errorf("state.max_age: %v must be positive", c.State.MaxAge)
+	}
+	senders := c.senderConfigs()
+	if len(senders) == 0 {
+		return fmt.Errorf("ntfy.topic: you have not defined a topic (or any other sender under notify)")
+	}
+	for _, sender := range senders {
+		if err := sender.Validate(); err != nil {
+			return fmt.Errorf("%v.%w", sender.key, err)
+		}
+	}
+	if c.HomeAssistant.Sensor != "" {
+		if c.HomeAssistant.Server == "" {
+			return fmt.Errorf("home_assistant.server: required when home_assistant.sensor is set")
+		}
+		if c.HomeAssistant.Token == "" {
+			return fmt.Errorf("home_assistant.token: required when home_assistant.sensor is set (or use home_assistant.token_file)")
+		}
+	}
+	if c.HomeAssistant.WebSocket && c.HomeAssistant.Sensor == "" {
+		return fmt.Errorf("home_assistant.websocket: requires home_assistant.sensor")
+	}
+	if c.HomeAssistant.RefreshEntity != "" && !c.HomeAssistant.WebSocket {
+		return fmt.Errorf("home_assistant.refresh_entity: requires home_assistant.websocket")
+	}
+	if err := c.Charger.Validate(); err != nil {
+		return fmt.Errorf("charger.%w", err)
+	}
+	if err := c.Peripherals.Validate(); err != nil {
+		return fmt.Errorf("peripherals.%w", err)
+	}
+	if c.ChargeLimit.Enabled() {
+		if err := c.ChargeLimit.Validate(); err != nil {
+			return fmt.Errorf("charge_limit.%w", err)
+		}
+		if c.ChargeLimit.Plug != "" && (c.HomeAssistant.Server == "" || c.HomeAssistant.Token == "") {
+			return fmt.Errorf("charge_limit.plug: requires home_assistant.server and home_assistant.token")
+		}
+	}
+	if c.Mqtt.Broker != "" {
+		if err := c.Mqtt.Validate(); err != nil {
+			return fmt.Errorf("mqtt.%w", err)
+		}
+	}
+	if err := c.Thresholds.Validate(); err != nil {
+		return fmt.Errorf("thresholds.%w", err)
+	}
+	if _, err := c.NewAlerter(power_sources.Status{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// get_state_config reads only the state section of the configuration
+// file, for commands which don't need anything else to be configured.
+func get_state_config(filename string) (StateConfig, error) {
+	config := struct {
+		State StateConfig `toml:"state"`
+	}{State: DefaultConfig().State}
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		if _, err := toml.Decode(string(data), &config); err != nil {
+			return config.State, fmt.Errorf("%v: %w", filename, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return config.State, err
+	}
+	return config.State, nil
+}
+
+// get_config reads the TOML configuration file, applies any
+// environment variable overrides and validates the result.
+// A missing file is not an error, as everything can be
+// provided by the environment.
+func get_config(filename string) (Config, error) {
+	config := DefaultConfig()
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		md, err := toml.Decode(string(data), &config)
+		if err != nil {
+			return config, fmt.Errorf("%v: %w", filename, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return config, fmt.Errorf("%v: unknown key %v", filename, undecoded[0])
+		}
+	} else if !os.IsNotExist(err) {
+		return config, err
+	}
+	if config.Ntfy.Topic == "" {
+		config.Ntfy.Topic = config.Topic
+	}
+	if err := config.applyEnvironment(); err != nil {
+		return config, err
+	}
+	for _, sender := range config.senderConfigs() {
+		sender.applyDefaults()
+	}
+	if config.Mqtt.Broker != "" {
+		config.Mqtt.applyDefaults()
+	}
+	if config.HomeAssistant.Token == "" && config.HomeAssistant.TokenFile != "" {
+		token, err := os.ReadFile(config.HomeAssistant.TokenFile)
+		if err != nil {
+			return config, fmt.Errorf("home_assistant.token_file: %w", err)
+		}
+		config.HomeAssistant.Token = strings.TrimSpace(string(token))
+	}
+	return config, config.Validate()
+}
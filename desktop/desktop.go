@@ -0,0 +1,136 @@
+package desktop
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+const (
+	destination = "org.freedesktop.Notifications"
+	path        = "/org/freedesktop/Notifications"
+	method      = "org.freedesktop.Notifications.Notify"
+)
+
+// urgencies maps ntfy's priority names onto the urgency hint:
+// 0 (low), 1 (normal) or 2 (critical).
+var urgencies = map[string]byte{
+	"min":     0,
+	"low":     0,
+	"default": 1,
+	"high":    1,
+	"max":     2,
+}
+
+// Urgency returns the notification urgency corresponding to an ntfy
+// priority name. Unrecognised names are treated as "default".
+func Urgency(priority string) byte {
+	if urgency, exists := urgencies[priority]; exists {
+		return urgency
+	}
+	return urgencies["default"]
+}
+
+type desktop struct {
+	appName string
+	mu      sync.Mutex
+	conn    *dbus.Conn
+	lastID  uint32 // the notification to replace, so only one is shown at a time
+}
+
+type Option func(d *desktop) error
+
+// WithAppName changes how notifications are attributed.
+func WithAppName(name string) Option {
+	return func(d *desktop) error {
+		d.appName = name
+		return nil
+	}
+}
+
+// icon returns the name of the standard battery icon closest to the
+// message's charge, such as "battery-level-40-charging-symbolic".
+func icon(message ntfy.Message) string {
+	if message.Battery == nil {
+		return "battery"
+	}
+	level := int(math.Round(message.Battery.Charge*10)) * 10
+	level = max(0, min(100, level))
+	if message.Battery.State == "Charging" {
+		return fmt.Sprintf("battery-level-%v-charging-symbolic", level)
+	}
+	return fmt.Sprintf("battery-level-%v-symbolic", level)
+}
+
+// connect returns the session bus connection, connecting if necessary.
+// The caller must hold d.mu.
+func (d *desktop) connect(ctx context.Context) (*dbus.Conn, error) {
+	if d.conn != nil && d.conn.Connected() {
+		return d.conn, nil
+	}
+	conn, err := dbus.ConnectSessionBus(dbus.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *desktop) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	logger.Info("Sending desktop notification", zap.String("message", message.Text), zap.String("priority", message.Priority))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("While connecting to the session bus: %w", err)
+	}
+	summary := message.Title
+	if summary == "" {
+		summary = "Battery"
+	}
+	urgency := Urgency(message.Priority)
+	hints := map[string]dbus.Variant{
+		"urgency":  dbus.MakeVariant(urgency),
+		"category": dbus.MakeVariant("device"),
+	}
+	expireTimeout := int32(-1) // the server's default
+	if urgency == 2 {
+		expireTimeout = 0 // until dismissed
+	}
+	var id uint32
+	err = conn.Object(destination, path).CallWithContext(
+		ctx,
+		method,
+		0,
+		d.appName,
+		d.lastID,
+		icon(message),
+		summary,
+		message.Text,
+		[]string{},
+		hints,
+		expireTimeout,
+	).Store(&id)
+	if err != nil {
+		return fmt.Errorf("While sending notification: %w", err)
+	}
+	d.lastID = id
+	return nil
+}
+
+// Create returns a sender showing notifications on the desktop,
+// using the D-Bus session bus.
+func Create(options ...Option) (*desktop, error) {
+	result := &desktop{appName: "battery_monitor"}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,205 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+// Security modes for the connection to the SMTP server.
+const (
+	StartTLS = "starttls" // upgrade a plain connection, usually on port 587
+	TLS      = "tls"      // implicit TLS, usually on port 465
+	None     = "none"     // unencrypted; only suitable for a local server
+)
+
+// xPriority maps ntfy's priority names onto the X-Priority header,
+// where 1 is the most urgent.
+var xPriority = map[string]int{
+	"min":     5,
+	"low":     4,
+	"default": 3,
+	"high":    2,
+	"max":     1,
+}
+
+type email struct {
+	address  string // host:port
+	security string
+	username string
+	password string
+	from     string
+	to       []string
+	hostname string
+}
+
+type Option func(e *email) error
+
+// WithSecurity chooses between StartTLS (the default), TLS and None.
+func WithSecurity(security string) Option {
+	return func(e *email) error {
+		switch security {
+		case StartTLS, TLS, None:
+			e.security = security
+			return nil
+		}
+		return fmt.Errorf("security: %q is not one of %v, %v, %v", security, StartTLS, TLS, None)
+	}
+}
+
+// WithAuth authenticates using PLAIN auth. The SMTP package refuses
+// to send the password over an unencrypted connection, except to localhost.
+func WithAuth(username, password string) Option {
+	return func(e *email) error {
+		e.username = username
+		e.password = password
+		return nil
+	}
+}
+
+// subject describes the battery if there is one, so alerts
+// about different machines can be told apart in an inbox.
+func (e *email) subject(message ntfy.Message) string {
+	if message.Battery != nil {
+		return fmt.Sprintf("%v battery %v", e.hostname, message.Battery.Summary)
+	}
+	if message.Title != "" {
+		return message.Title
+	}
+	subject, _, _ := strings.Cut(message.Text, "\n")
+	return subject
+}
+
+func (e *email) compose(message ntfy.Message) []byte {
+	buf := new(bytes.Buffer)
+	headers := [][2]string{
+		{"From", e.from},
+		{"To", strings.Join(e.to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.subject(message))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "8bit"},
+	}
+	if priority, exists := xPriority[message.Priority]; exists {
+		headers = append(headers, [2]string{"X-Priority", fmt.Sprint(priority)})
+	}
+	for _, header := range headers {
+		fmt.Fprintf(buf, "%v: %v\r\n", header[0], header[1])
+	}
+	buf.WriteString("\r\n")
+	if message.Title != "" && message.Battery != nil {
+		buf.WriteString(message.Title + "\r\n\r\n")
+	}
+	buf.WriteString(strings.ReplaceAll(message.Text, "\n", "\r\n"))
+	if message.Click != "" {
+		buf.WriteString("\r\n\r\n" + message.Click)
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// dial connects to the server, securing the connection as configured.
+func (e *email) dial(ctx context.Context) (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(e.address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	var conn net.Conn
+	if e.security == TLS {
+		dialer := &tls.Dialer{Config: tlsConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", e.address)
+	} else {
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", e.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if e.security == StartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("While starting TLS: %w", err)
+		}
+	}
+	return client, nil
+}
+
+func (e *email) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	logger.Info("Sending email", zap.String("message", message.Text), zap.Strings("to", e.to))
+	client, err := e.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("While connecting to %v: %w", e.address, err)
+	}
+	defer client.Close()
+	if e.username != "" {
+		host, _, _ := net.SplitHostPort(e.address)
+		if err := client.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return fmt.Errorf("While authenticating: %w", err)
+		}
+	}
+	if err := client.Mail(e.from); err != nil {
+		return err
+	}
+	for _, recipient := range e.to {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("While adding recipient %v: %w", recipient, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(e.compose(message)); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Create returns a sender emailing the recipients via the
+// SMTP server at address (host:port).
+func Create(address, from string, to []string, options ...Option) (*email, error) {
+	if len(to) == 0 {
+		return nil, fmt.Errorf("to: there must be at least one recipient")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	result := &email{
+		address:  address,
+		security: StartTLS,
+		from:     from,
+		to:       to,
+		hostname: hostname,
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package email
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+// received is what the stand-in SMTP server was sent.
+type received struct {
+	from       string
+	recipients []string
+	data       string
+}
+
+// serveSMTP speaks just enough SMTP to accept a single message.
+func serveSMTP(t *testing.T, listener net.Listener, result chan<- received) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	text := textproto.NewConn(conn)
+	var message received
+	text.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		verb, argument, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			text.PrintfLine("250 localhost")
+		case "MAIL":
+			message.from = argument
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			message.recipients = append(message.recipients, argument)
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			message.data = string(data)
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			result <- message
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	result := make(chan received, 1)
+	go serveSMTP(t, listener, result)
+
+	sender, err := Create(
+		listener.Addr().String(),
+		"monitor@example.com",
+		[]string{"alice@example.com", "bob@example.com"},
+		WithSecurity(None),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.hostname = "laptop"
+	err = sender.Send(context.Background(), zap.NewNop(), ntfy.Message{
+		Title:    "Battery low",
+		Text:     "Plug in soon.\nIt is discharging.",
+		Priority: "high",
+		Battery:  &ntfy.Battery{Summary: "15% [Discharging]", Charge: 0.15, State: "Discharging"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := <-result
+
+	if message.from != "FROM:<monitor@example.com>" {
+		t.Errorf("unexpected MAIL %q", message.from)
+	}
+	if len(message.recipients) != 2 || message.recipients[0] != "TO:<alice@example.com>" || message.recipients[1] != "TO:<bob@example.com>" {
+		t.Errorf("unexpected RCPT %q", message.recipients)
+	}
+	parsed, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(message.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, expected := range map[string]string{
+		"From":       "monitor@example.com",
+		"To":         "alice@example.com, bob@example.com",
+		"Subject":    "laptop battery 15% [Discharging]",
+		"X-Priority": "2",
+	} {
+		if actual := parsed.Header.Get(header); actual != expected {
+			t.Errorf("%v: got %q, expected %q", header, actual, expected)
+		}
+	}
+	body := new(strings.Builder)
+	if _, err := bufio.NewReader(parsed.Body).WriteTo(body); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Battery low\n\nPlug in soon.\nIt is discharging.\n"; body.String() != expected {
+		t.Errorf("got body %q, expected %q", body.String(), expected)
+	}
+}
+
+func TestSubject(t *testing.T) {
+	sender, err := Create("localhost:25", "monitor@example.com", []string{"alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		message  ntfy.Message
+		expected string
+	}{
+		{ntfy.Message{Title: "Charger is too weak", Text: "details"}, "Charger is too weak"},
+		{ntfy.Message{Text: "first line\nsecond line"}, "first line"},
+	} {
+		if actual := sender.subject(test.message); actual != test.expected {
+			t.Errorf("subject(%+v) = %q, expected %q", test.message, actual, test.expected)
+		}
+	}
+}
@@ -4,6 +4,9 @@ go 1.22.2
 
 require (
 	github.com/BurntSushi/toml v1.4.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/godbus/dbus/v5 v5.1.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/joho/godotenv v1.5.1
 	go.uber.org/zap v1.27.0
 )
@@ -11,4 +14,6 @@ require (
 require (
 	github.com/stretchr/testify v1.8.4 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 )
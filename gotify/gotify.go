@@ -0,0 +1,126 @@
+package gotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+// priorities maps ntfy's priority names onto Gotify's numeric
+// priorities, which clients conventionally treat as
+// 0: silent, 1-3: quiet, 4-7: sound, 8-10: urgent.
+var priorities = map[string]int{
+	"min":     0,
+	"low":     2,
+	"default": 5,
+	"high":    8,
+	"max":     10,
+}
+
+// Priority returns the Gotify priority corresponding to an ntfy
+// priority name. Unrecognised names are treated as "default".
+func Priority(name string) int {
+	if priority, exists := priorities[name]; exists {
+		return priority
+	}
+	return priorities["default"]
+}
+
+type gotify struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+type Option func(g *gotify) error
+
+// WithClient uses the given HTTP client rather than the default one.
+func WithClient(client *http.Client) Option {
+	return func(g *gotify) error {
+		g.client = client
+		return nil
+	}
+}
+
+type message struct {
+	Title    string         `json:"title,omitempty"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+// errorResponse is what Gotify responds with when it rejects a message.
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorCode        int    `json:"errorCode"`
+	ErrorDescription string `json:"errorDescription"`
+}
+
+func (g *gotify) Send(ctx context.Context, logger *zap.Logger, m ntfy.Message) error {
+	logger.Info("Sending to Gotify", zap.String("message", m.Text), zap.String("priority", m.Priority))
+	body := message{
+		Title:    m.Title,
+		Message:  m.Text,
+		Priority: Priority(m.Priority),
+	}
+	extras := map[string]any{}
+	if m.Markdown {
+		extras["client::display"] = map[string]string{"contentType": "text/markdown"}
+	}
+	if m.Click != "" {
+		extras["client::notification"] = map[string]any{"click": map[string]string{"url": m.Click}}
+	}
+	if len(extras) > 0 {
+		body.Extras = extras
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", g.server+"/message", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Gotify-Key", g.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("While trying to write to %v: %w", g.server, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("While reading response from gotify: %w", err)
+		}
+		var decoded errorResponse
+		if err := json.Unmarshal(respBytes, &decoded); err == nil && decoded.Error != "" {
+			return fmt.Errorf("gotify responded with %v: %v: %v", resp.StatusCode, decoded.Error, decoded.ErrorDescription)
+		}
+		return fmt.Errorf("gotify responded with %v: %v", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	return nil
+}
+
+// Create returns a sender posting to the Gotify server
+// (e.g. https://gotify.example.com) using an application token.
+func Create(server, token string, options ...Option) (*gotify, error) {
+	result := &gotify{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		client: http.DefaultClient,
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package gotify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+func TestPriority(t *testing.T) {
+	for name, expected := range map[string]int{
+		"min":     0,
+		"low":     2,
+		"default": 5,
+		"high":    8,
+		"max":     10,
+		"":        5,
+		"unknown": 5,
+	} {
+		if actual := Priority(name); actual != expected {
+			t.Errorf("Priority(%q) = %v, expected %v", name, actual, expected)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	var received message
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/message" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		if key := r.Header.Get("X-Gotify-Key"); key != "secret" {
+			t.Errorf("unexpected X-Gotify-Key %q", key)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("unexpected Content-Type %q", contentType)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	defer server.Close()
+
+	sender, err := Create(server.URL+"/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sender.Send(context.Background(), zap.NewNop(), ntfy.Message{
+		Title:    "Battery low",
+		Text:     "10% [Discharging]",
+		Priority: "high",
+		Markdown: true,
+		Click:    "https://example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Title != "Battery low" || received.Message != "10% [Discharging]" || received.Priority != 8 {
+		t.Errorf("unexpected message %+v", received)
+	}
+	display, _ := received.Extras["client::display"].(map[string]any)
+	if display["contentType"] != "text/markdown" {
+		t.Errorf("markdown not requested: %+v", received.Extras)
+	}
+	if _, exists := received.Extras["client::notification"]; !exists {
+		t.Errorf("click URL not sent: %+v", received.Extras)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	for name, test := range map[string]struct {
+		body     string
+		expected string
+	}{
+		"gotify error": {
+			body:     `{"error": "Unauthorized", "errorCode": 401, "errorDescription": "you need to provide a valid access token"}`,
+			expected: "gotify responded with 401: Unauthorized: you need to provide a valid access token",
+		},
+		"other error": {
+			body:     "go away\n",
+			expected: "gotify responded with 401: go away",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			sender, err := Create(server.URL, "wrong")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sender.Send(context.Background(), zap.NewNop(), ntfy.Message{Text: "hello"})
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected an error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,8 +30,8 @@ func (lv LastValue) IsSame(value []byte) bool {
 // are close enough to not be worth reporting the new value of.
 // At least one of the thresholds needs to be breached, not both.
 type SensorTolerance struct {
-	Absolute float32 // must be >0 to ever match
-	Relative float32 // must be >1 to ever match
+	Absolute float32 `toml:"absolute"` // must be >0 to ever match
+	Relative float32 `toml:"relative"` // must be >1 to ever match
 }
 
 func (st SensorTolerance) CloseEnough(oldValue, newValue float32) bool {
@@ -102,7 +104,7 @@ func NewHomeAssistantRestApi(server, token string, options ...haOption) *HaRestA
 		writeTimeout:       15 * time.Second,
 		token:              token, // auth token
 		client:             &http.Client{},
-		server:             server, // URL
+		server:             strings.TrimSuffix(server, "/"), // URL
 		lastValues:         make(map[string]LastValue),
 		lastNumericValues:  make(map[string]float32),
 		numericTolerances:  make(map[string]SensorTolerance),
@@ -114,7 +116,12 @@ func NewHomeAssistantRestApi(server, token string, options ...haOption) *HaRestA
 }
 
 type HaAttributes struct {
+	FriendlyName      string `json:"friendly_name,omitempty"`
+	DeviceClass       string `json:"device_class,omitempty"`
 	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+	Manufacturer      string `json:"manufacturer,omitempty"`
+	Model             string `json:"model,omitempty"`
+	Technology        string `json:"technology,omitempty"`
 }
 
 type HaRestMessage struct {
@@ -171,6 +178,51 @@ func (a *HaRestApi) MarkUnavailable(
 	)
 }
 
+// HaSnapshot holds what HaRestApi remembers about the values it has
+// sent, so it can avoid resending them after a restart.
+type HaSnapshot struct {
+	Values        map[string]SavedValue `json:"values"`
+	NumericValues map[string]float32    `json:"numeric_values"`
+}
+
+type SavedValue struct {
+	Value  []byte    `json:"value"`
+	Expiry time.Time `json:"expiry"`
+}
+
+func (a *HaRestApi) Snapshot() HaSnapshot {
+	result := HaSnapshot{
+		Values:        make(map[string]SavedValue, len(a.lastValues)),
+		NumericValues: maps.Clone(a.lastNumericValues),
+	}
+	for sensor, lv := range a.lastValues {
+		result.Values[sensor] = SavedValue{Value: lv.value, Expiry: lv.expiry}
+	}
+	return result
+}
+
+// Restore reinstates a snapshot, disregarding any values which have expired.
+// Numeric values expire along with the value last sent for the same sensor.
+func (a *HaRestApi) Restore(snapshot HaSnapshot) {
+	for sensor, sv := range snapshot.Values {
+		if time.Since(sv.Expiry) < 0 {
+			a.lastValues[sensor] = LastValue{value: sv.Value, expiry: sv.Expiry}
+		}
+	}
+	for sensor, value := range snapshot.NumericValues {
+		if _, exists := a.lastValues[sensor]; exists {
+			a.lastNumericValues[sensor] = value
+		}
+	}
+}
+
+// Forget discards what has been sent, so everything will be
+// sent again, even if unchanged.
+func (a *HaRestApi) Forget() {
+	clear(a.lastValues)
+	clear(a.lastNumericValues)
+}
+
 func (a *HaRestApi) LastNumericState(sensor string) (float32, bool) {
 	value, exists := a.lastNumericValues[sensor]
 	return value, exists
@@ -182,9 +234,23 @@ func (a *HaRestApi) UpdateNumericState(
 	value float32,
 	unit string,
 	precision int,
+) error {
+	return a.UpdateNumericStateWithAttributes(ctx, sensor, value, HaAttributes{UnitOfMeasurement: unit}, precision)
+}
+
+// UpdateNumericStateWithAttributes is like UpdateNumericState, but
+// allows attributes other than the unit to be sent too.
+func (a *HaRestApi) UpdateNumericStateWithAttributes(
+	ctx context.Context,
+	sensor string,
+	value float32,
+	attributes HaAttributes,
+	precision int,
 ) error {
 	if tolerance, exists := a.numericTolerances[sensor]; exists {
+		// once the value last sent has expired, it is sent again regardless
 		if lastNumericValue, exists := a.lastNumericValues[sensor]; exists &&
+			time.Since(a.lastValues[sensor].expiry) < 0 &&
 			tolerance.CloseEnough(lastNumericValue, value) {
 			logger.Debug(
 				"not sending new value as it's too close to the old one",
@@ -201,7 +267,7 @@ func (a *HaRestApi) UpdateNumericState(
 		sensor,
 		HaRestMessage{
 			State:      state,
-			Attributes: HaAttributes{UnitOfMeasurement: unit},
+			Attributes: attributes,
 		},
 	)
 	if err == nil {
@@ -285,7 +351,7 @@ func (a *HaRestApi) GetState(ctx context.Context, sensor string) (HaRestMessage,
 	ctx, cancel := context.WithTimeout(ctx, a.readTimeout)
 	defer cancel()
 	result := HaRestMessage{}
-	url := fmt.Sprintf("https://qck.duckdns.org/api/states/%v", sensor)
+	url := fmt.Sprintf("%v/api/states/%v", a.server, sensor)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return result, err
@@ -328,7 +394,7 @@ func (a *HaRestApi) UpdateState(ctx context.Context, sensor string, message HaRe
 		return err
 	}
 	payload := payloadBuf.Bytes()
-	url := fmt.Sprintf("https://qck.duckdns.org/api/states/%v", sensor)
+	url := fmt.Sprintf("%v/api/states/%v", a.server, sensor)
 	if previous, exists := a.lastValues[sensor]; exists && previous.IsSame(payload) {
 		logger.Debug(
 			"not updating as the value has not changed",
@@ -374,3 +440,38 @@ func (a *HaRestApi) UpdateState(ctx context.Context, sensor string, message HaRe
 		zap.String("message", string(payload)))
 	return nil
 }
+
+// CallService calls a Home Assistant service, such as switch.turn_off,
+// with the given data (e.g. the entity_id to act on).
+func (a *HaRestApi) CallService(ctx context.Context, domain, service string, data any) error {
+	ctx, cancel := context.WithTimeout(ctx, a.writeTimeout)
+	defer cancel()
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%v/api/services/%v/%v", a.server, domain, service)
+	if a.readOnly {
+		logger.Info(
+			"would normally call service",
+			zap.String("URL", url),
+			zap.String("data", string(payload)))
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", a.token))
+	req.Header.Add("content-type", "application/json")
+	response, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 {
+		respBytes, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("While calling %v.%v: unexpected response %v: %v", domain, service, response.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	return nil
+}
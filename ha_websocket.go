@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// ErrNotConnected is returned by commands sent while
+// the WebSocket connection is down.
+var ErrNotConnected = errors.New("not connected to Home Assistant")
+
+// HaState is an entity's state, as reported by Home Assistant.
+type HaState struct {
+	EntityID    string          `json:"entity_id"`
+	State       string          `json:"state"`
+	Attributes  json.RawMessage `json:"attributes"`
+	LastChanged time.Time       `json:"last_changed"`
+	LastUpdated time.Time       `json:"last_updated"`
+}
+
+// HaStateChange describes an entity changing state.
+// Old is nil for new entities, and New is nil for removed ones.
+type HaStateChange struct {
+	EntityID string
+	Old      *HaState
+	New      *HaState
+}
+
+type haSubscription struct {
+	command map[string]any // sent again after reconnecting
+	handler func(HaStateChange)
+}
+
+type haResult struct {
+	Success bool            `json:"success"`
+	Result  json.RawMessage `json:"result"`
+	Error   *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// haIncoming is any message sent by Home Assistant.
+type haIncoming struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	Message string `json:"message"` // explains auth_invalid
+	haResult
+	Event struct {
+		// subscribe_events
+		Data struct {
+			EntityID string   `json:"entity_id"`
+			OldState *HaState `json:"old_state"`
+			NewState *HaState `json:"new_state"`
+		} `json:"data"`
+		// subscribe_trigger
+		Variables struct {
+			Trigger struct {
+				EntityID  string   `json:"entity_id"`
+				FromState *HaState `json:"from_state"`
+				ToState   *HaState `json:"to_state"`
+			} `json:"trigger"`
+		} `json:"variables"`
+	} `json:"event"`
+}
+
+func (m haIncoming) stateChange() HaStateChange {
+	if trigger := m.Event.Variables.Trigger; trigger.EntityID != "" {
+		return HaStateChange{EntityID: trigger.EntityID, Old: trigger.FromState, New: trigger.ToState}
+	}
+	data := m.Event.Data
+	return HaStateChange{EntityID: data.EntityID, Old: data.OldState, New: data.NewState}
+}
+
+// HaWebSocket is a client for Home Assistant's WebSocket API,
+// which pushes state changes as they happen rather than needing
+// them to be polled. Once Run is called, it stays connected,
+// reconnecting and renewing its subscriptions as necessary.
+type HaWebSocket struct {
+	url            string
+	token          string
+	commandTimeout time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	onConnect      func()
+	restMu         sync.Mutex // HaRestApi is not safe for concurrent use
+	rest           *HaRestApi // for setting states
+
+	mu            sync.Mutex
+	conn          *websocket.Conn // nil when disconnected
+	nextID        int
+	pending       map[int]chan haResult
+	subscriptions []*haSubscription
+	active        map[int]*haSubscription // by the id used to subscribe on this connection
+}
+
+type haWebSocketOption func(h *HaWebSocket) error
+
+// WithOnConnect calls f each time a connection is established,
+// after subscribing. As Home Assistant forgets states set through
+// the REST API when it restarts, this is a chance to set them again.
+func WithOnConnect(f func()) haWebSocketOption {
+	return func(h *HaWebSocket) error {
+		h.onConnect = f
+		return nil
+	}
+}
+
+// WithBackoff sets how long to wait before reconnecting,
+// doubling from min up to max while attempts keep failing.
+func WithBackoff(min, max time.Duration) haWebSocketOption {
+	return func(h *HaWebSocket) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("invalid backoff from %v to %v", min, max)
+		}
+		h.minBackoff, h.maxBackoff = min, max
+		return nil
+	}
+}
+
+// websocketURL converts a server such as https://homeassistant.local:8123
+// to the address of its WebSocket API.
+func websocketURL(server string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported scheme in %v", server)
+	}
+	u.Path += "/api/websocket"
+	return u.String(), nil
+}
+
+func NewHaWebSocket(server, token string, options ...haWebSocketOption) (*HaWebSocket, error) {
+	wsURL, err := websocketURL(server)
+	if err != nil {
+		return nil, err
+	}
+	result := &HaWebSocket{
+		url:            wsURL,
+		token:          token,
+		rest:           NewHomeAssistantRestApi(server, token),
+		commandTimeout: 15 * time.Second,
+		minBackoff:     time.Second,
+		maxBackoff:     5 * time.Minute,
+		pending:        make(map[int]chan haResult),
+		active:         make(map[int]*haSubscription),
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Run keeps the connection open until the context is cancelled.
+func (h *HaWebSocket) Run(ctx context.Context) {
+	backoff := h.minBackoff
+	for {
+		connected, err := h.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = h.minBackoff
+		}
+		logger.Warn("Home Assistant WebSocket disconnected", zap.Error(err), zap.Duration("reconnecting in", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, h.maxBackoff)
+	}
+}
+
+// session connects, then handles incoming messages until the
+// connection fails. It reports whether authentication succeeded.
+func (h *HaWebSocket) session(ctx context.Context) (bool, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, h.url, nil)
+	if err != nil {
+		return false, fmt.Errorf("While connecting to %v: %w", h.url, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := h.authenticate(conn); err != nil {
+		return false, err
+	}
+	h.mu.Lock()
+	h.conn = conn
+	h.nextID = 1
+	clear(h.active)
+	// later subscriptions are made as they are added
+	subscriptions := h.subscriptions
+	h.mu.Unlock()
+	defer h.disconnected()
+
+	go func() {
+		if err := h.resubscribe(conn, subscriptions); err != nil {
+			logger.Warn("While subscribing to Home Assistant", zap.Error(err))
+			conn.Close() // start again
+			return
+		}
+		logger.Info("Connected to Home Assistant WebSocket", zap.String("url", h.url))
+		if h.onConnect != nil {
+			h.onConnect()
+		}
+	}()
+	for {
+		var message haIncoming
+		if err := conn.ReadJSON(&message); err != nil {
+			return true, err
+		}
+		h.dispatch(message)
+	}
+}
+
+func (h *HaWebSocket) authenticate(conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(h.commandTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	var message haIncoming
+	if err := conn.ReadJSON(&message); err != nil {
+		return err
+	}
+	if message.Type != "auth_required" {
+		return fmt.Errorf("expected auth_required, not %v", message.Type)
+	}
+	if err := conn.WriteJSON(map[string]string{"type": "auth", "access_token": h.token}); err != nil {
+		return err
+	}
+	if err := conn.ReadJSON(&message); err != nil {
+		return err
+	}
+	switch message.Type {
+	case "auth_ok":
+		return nil
+	case "auth_invalid":
+		return fmt.Errorf("Home Assistant rejected the token: %v", message.Message)
+	}
+	return fmt.Errorf("expected auth_ok, not %v", message.Type)
+}
+
+// disconnected fails any commands still awaiting a result.
+func (h *HaWebSocket) disconnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conn = nil
+	for id, result := range h.pending {
+		close(result)
+		delete(h.pending, id)
+	}
+}
+
+func (h *HaWebSocket) dispatch(message haIncoming) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch message.Type {
+	case "result":
+		if result, exists := h.pending[message.ID]; exists {
+			result <- message.haResult
+			delete(h.pending, message.ID)
+		}
+	case "event":
+		if subscription, exists := h.active[message.ID]; exists {
+			// handlers may send commands, which needs the lock
+			go subscription.handler(message.stateChange())
+		}
+	}
+}
+
+// resubscribe renews the subscriptions on a new connection.
+func (h *HaWebSocket) resubscribe(conn *websocket.Conn, subscriptions []*haSubscription) error {
+	for _, subscription := range subscriptions {
+		if err := h.subscribe(context.Background(), conn, subscription); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HaWebSocket) subscribe(ctx context.Context, conn *websocket.Conn, subscription *haSubscription) error {
+	_, err := h.command(ctx, conn, subscription.command, func(id int) {
+		h.active[id] = subscription
+	})
+	return err
+}
+
+// command sends a command and waits for its result. Before the
+// command is sent, registered is called (with the lock held) with
+// the id it was given. If conn is not nil, the command is only sent
+// if it is still the current connection, so that work for a session
+// which has since ended isn't done on its successor.
+func (h *HaWebSocket) command(ctx context.Context, conn *websocket.Conn, command map[string]any, registered func(id int)) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.commandTimeout)
+	defer cancel()
+	result := make(chan haResult, 1)
+	h.mu.Lock()
+	if h.conn == nil || (conn != nil && conn != h.conn) {
+		h.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	id := h.nextID
+	h.nextID++
+	message := map[string]any{"id": id}
+	for k, v := range command {
+		message[k] = v
+	}
+	h.pending[id] = result
+	if registered != nil {
+		registered(id)
+	}
+	// holding the lock also stops writes from overlapping
+	err := h.conn.WriteJSON(message)
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+		return nil, fmt.Errorf("While waiting for %v: %w", command["type"], ctx.Err())
+	case r, ok := <-result:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		if !r.Success {
+			if r.Error != nil {
+				return nil, fmt.Errorf("%v failed: %v (%v)", command["type"], r.Error.Message, r.Error.Code)
+			}
+			return nil, fmt.Errorf("%v failed", command["type"])
+		}
+		return r.Result, nil
+	}
+}
+
+// SubscribeStateChanges calls handler whenever one of the entities
+// changes state, or any entity at all if none are given. The
+// subscription is renewed whenever the connection is reestablished.
+// If not currently connected, it is only made once connected.
+func (h *HaWebSocket) SubscribeStateChanges(ctx context.Context, handler func(HaStateChange), entityIDs ...string) error {
+	command := map[string]any{"type": "subscribe_events", "event_type": "state_changed"}
+	if len(entityIDs) > 0 {
+		command = map[string]any{
+			"type":    "subscribe_trigger",
+			"trigger": map[string]any{"platform": "state", "entity_id": entityIDs},
+		}
+	}
+	subscription := &haSubscription{command: command, handler: handler}
+	h.mu.Lock()
+	h.subscriptions = append(h.subscriptions, subscription)
+	conn := h.conn
+	h.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	if err := h.subscribe(ctx, conn, subscription); !errors.Is(err, ErrNotConnected) {
+		return err
+	}
+	// it is made once (re)connected
+	return nil
+}
+
+// GetStates returns the current state of every entity.
+func (h *HaWebSocket) GetStates(ctx context.Context) ([]HaState, error) {
+	raw, err := h.command(ctx, nil, map[string]any{"type": "get_states"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var states []HaState
+	return states, json.Unmarshal(raw, &states)
+}
+
+// GetState returns the current state of an entity.
+func (h *HaWebSocket) GetState(ctx context.Context, entityID string) (HaState, error) {
+	states, err := h.GetStates(ctx)
+	if err != nil {
+		return HaState{}, err
+	}
+	for _, state := range states {
+		if state.EntityID == entityID {
+			return state, nil
+		}
+	}
+	return HaState{}, fmt.Errorf("%v does not exist", entityID)
+}
+
+// CallService changes entities' states, e.g. calling switch.turn_off
+// with a target of {"entity_id": "switch.laptop_charger"}.
+func (h *HaWebSocket) CallService(ctx context.Context, domain, service string, data, target map[string]any) error {
+	command := map[string]any{"type": "call_service", "domain": domain, "service": service}
+	if data != nil {
+		command["service_data"] = data
+	}
+	if target != nil {
+		command["target"] = target
+	}
+	_, err := h.command(ctx, nil, command, nil)
+	return err
+}
+
+// SetState sets an entity's state directly, as HaRestApi.UpdateState
+// does. As the WebSocket API has no command for this, it is done
+// through the REST API of the same server, whether or not the
+// WebSocket is connected.
+func (h *HaWebSocket) SetState(ctx context.Context, entityID string, message HaRestMessage) error {
+	h.restMu.Lock()
+	defer h.restMu.Unlock()
+	return h.rest.UpdateState(ctx, entityID, message)
+}
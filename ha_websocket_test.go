@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+// fakeHa is a stand-in for Home Assistant's WebSocket API. Each
+// connection is handled by session, once it has authenticated.
+type fakeHa struct {
+	t       *testing.T
+	token   string
+	session func(n int, conn *websocket.Conn)
+
+	mu          sync.Mutex
+	connections int
+}
+
+func (f *fakeHa) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	defer conn.Close()
+	conn.WriteJSON(map[string]string{"type": "auth_required"})
+	var auth map[string]string
+	if err := conn.ReadJSON(&auth); err != nil {
+		return
+	}
+	if auth["type"] != "auth" || auth["access_token"] != f.token {
+		conn.WriteJSON(map[string]string{"type": "auth_invalid", "message": "Invalid access token"})
+		return
+	}
+	conn.WriteJSON(map[string]string{"type": "auth_ok"})
+	f.mu.Lock()
+	f.connections++
+	n := f.connections
+	f.mu.Unlock()
+	f.session(n, conn)
+}
+
+// start returns the address of the server, which is
+// closed once the test is done.
+func (f *fakeHa) start() string {
+	server := httptest.NewServer(f)
+	f.t.Cleanup(server.Close)
+	return server.URL
+}
+
+type fakeCommand struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+}
+
+func succeed(conn *websocket.Conn, id int, result any) error {
+	return conn.WriteJSON(map[string]any{"id": id, "type": "result", "success": true, "result": result})
+}
+
+func TestWebSocketURL(t *testing.T) {
+	for server, expected := range map[string]string{
+		"http://homeassistant.local:8123":   "ws://homeassistant.local:8123/api/websocket",
+		"https://ha.example.com/":           "wss://ha.example.com/api/websocket",
+		"https://example.com/homeassistant": "wss://example.com/homeassistant/api/websocket",
+	} {
+		actual, err := websocketURL(server)
+		if err != nil || actual != expected {
+			t.Errorf("websocketURL(%q) = %q, %v; expected %q", server, actual, err, expected)
+		}
+	}
+	if _, err := websocketURL("ftp://example.com"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	fake := &fakeHa{t: t, token: "secret", session: func(n int, conn *websocket.Conn) {
+		for {
+			var command fakeCommand
+			if err := conn.ReadJSON(&command); err != nil {
+				return
+			}
+			succeed(conn, command.ID, []HaState{{EntityID: "sun.sun", State: "above_horizon"}})
+		}
+	}}
+	server := fake.start()
+
+	t.Run("accepted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		connected := make(chan struct{}, 1)
+		ws, err := NewHaWebSocket(server, "secret", WithOnConnect(func() { connected <- struct{}{} }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go ws.Run(ctx)
+		select {
+		case <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not connect")
+		}
+		state, err := ws.GetState(ctx, "sun.sun")
+		if err != nil || state.State != "above_horizon" {
+			t.Errorf("unexpected state %+v, %v", state, err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		ws, err := NewHaWebSocket(server, "wrong")
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticated, err := ws.session(context.Background())
+		if authenticated || err == nil || !strings.Contains(err.Error(), "rejected the token") {
+			t.Errorf("expected the token to be rejected, got %v, %v", authenticated, err)
+		}
+		if _, err := ws.GetStates(context.Background()); err != ErrNotConnected {
+			t.Errorf("expected ErrNotConnected, got %v", err)
+		}
+	})
+}
+
+func TestResubscribe(t *testing.T) {
+	var mu sync.Mutex
+	subscriptions := map[int]int{} // by connection
+	fake := &fakeHa{t: t, token: "secret"}
+	fake.session = func(n int, conn *websocket.Conn) {
+		for {
+			var command fakeCommand
+			if err := conn.ReadJSON(&command); err != nil {
+				return
+			}
+			if command.Type != "subscribe_trigger" {
+				succeed(conn, command.ID, nil)
+				continue
+			}
+			mu.Lock()
+			subscriptions[n]++
+			mu.Unlock()
+			succeed(conn, command.ID, nil)
+			if n == 1 {
+				// drop the first connection once subscribed
+				return
+			}
+			conn.WriteJSON(map[string]any{
+				"id":   command.ID,
+				"type": "event",
+				"event": map[string]any{"variables": map[string]any{"trigger": map[string]any{
+					"entity_id":  "input_button.refresh",
+					"from_state": map[string]any{"entity_id": "input_button.refresh", "state": "1"},
+					"to_state":   map[string]any{"entity_id": "input_button.refresh", "state": "2"},
+				}}},
+			})
+		}
+	}
+	server := fake.start()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connected := make(chan struct{}, 2)
+	ws, err := NewHaWebSocket(server, "secret",
+		WithOnConnect(func() { connected <- struct{}{} }),
+		WithBackoff(10*time.Millisecond, 50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan HaStateChange, 1)
+	if err := ws.SubscribeStateChanges(ctx, func(change HaStateChange) { changes <- change }, "input_button.refresh"); err != nil {
+		t.Fatal(err)
+	}
+	go ws.Run(ctx)
+
+	select {
+	case change := <-changes:
+		if change.EntityID != "input_button.refresh" || change.Old.State != "1" || change.New.State != "2" {
+			t.Errorf("unexpected change %+v", change)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after reconnecting")
+	}
+	// onConnect is only called once all subscriptions have been made
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("onConnect was not called")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if subscriptions[1] != 1 || subscriptions[2] != 1 {
+		t.Errorf("expected one subscription on each connection, got %v", subscriptions)
+	}
+}
+
+func TestSetState(t *testing.T) {
+	var received HaRestMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/states/sensor.laptop_battery" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ws, err := NewHaWebSocket(server.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ws.SetState(context.Background(), "sensor.laptop_battery", HaRestMessage{
+		State:      "42",
+		Attributes: HaAttributes{UnitOfMeasurement: "%"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.State != "42" || received.Attributes.UnitOfMeasurement != "%" {
+		t.Errorf("unexpected state %+v", received)
+	}
+}
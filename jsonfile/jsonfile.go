@@ -0,0 +1,25 @@
+package jsonfile
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Save writes the data as JSON via a temporary file, so an
+// interrupted write cannot leave a truncated file behind. Any
+// missing directories are created, readable only by the user.
+func Save(filename string, data any) error {
+	fileData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, fileData, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,224 @@
+package matrix
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+type matrix struct {
+	homeserver string
+	token      string
+	room       string
+	html       bool
+	attempts   int
+	retryDelay time.Duration
+	client     *http.Client
+}
+
+type Option func(m *matrix) error
+
+// WithHTML also sends an HTML version of each message,
+// with the charge shown in a colour reflecting how low it is.
+func WithHTML(m *matrix) error {
+	m.html = true
+	return nil
+}
+
+// WithRetries makes up to the given number of attempts to send
+// each message, doubling the delay between each one. Every attempt
+// uses the same transaction id, so the homeserver will not
+// duplicate a message if an earlier attempt did in fact succeed.
+func WithRetries(attempts int, initialDelay time.Duration) Option {
+	return func(m *matrix) error {
+		if attempts < 1 {
+			return fmt.Errorf("at least one attempt is required, not %v", attempts)
+		}
+		m.attempts = attempts
+		m.retryDelay = initialDelay
+		return nil
+	}
+}
+
+// WithClient uses the given HTTP client rather than the default one.
+func WithClient(client *http.Client) Option {
+	return func(m *matrix) error {
+		m.client = client
+		return nil
+	}
+}
+
+type event struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// errorResponse is the standard Matrix error body.
+type errorResponse struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMs int    `json:"retry_after_ms"`
+}
+
+type responseError struct {
+	statusCode int
+	response   errorResponse
+}
+
+func (e responseError) Error() string {
+	return fmt.Sprintf("matrix responded with %v: %v: %v", e.statusCode, e.response.ErrCode, e.response.Error)
+}
+
+func (e responseError) temporary() bool {
+	return e.statusCode >= 500 || e.statusCode == http.StatusTooManyRequests
+}
+
+// colour reflects how urgently the battery needs charging.
+func colour(charge float64) string {
+	switch {
+	case charge < 0.2:
+		return "#d32f2f"
+	case charge < 0.5:
+		return "#f57c00"
+	}
+	return "#388e3c"
+}
+
+func (m *matrix) event(message ntfy.Message) event {
+	body := message.Text
+	if message.Title != "" {
+		body = message.Title + "\n" + body
+	}
+	result := event{MsgType: "m.text", Body: body}
+	if message.Priority == "min" || message.Priority == "low" {
+		result.MsgType = "m.notice"
+	}
+	if !m.html {
+		return result
+	}
+	formatted := new(strings.Builder)
+	if message.Battery != nil {
+		fmt.Fprintf(
+			formatted,
+			`<font data-mx-color="%v"><b>%.0f%%</b></font> `,
+			colour(message.Battery.Charge),
+			message.Battery.Charge*100,
+		)
+	}
+	if message.Title != "" {
+		fmt.Fprintf(formatted, "<b>%v</b><br>", html.EscapeString(message.Title))
+	}
+	formatted.WriteString(strings.ReplaceAll(html.EscapeString(message.Text), "\n", "<br>"))
+	if message.Click != "" {
+		fmt.Fprintf(formatted, `<br><a href="%v">%v</a>`, html.EscapeString(message.Click), html.EscapeString(message.Click))
+	}
+	result.Format = "org.matrix.custom.html"
+	result.FormattedBody = formatted.String()
+	return result
+}
+
+// transactionID identifies the message, so sending it again
+// is recognised by the homeserver as a retry.
+func (m *matrix) transactionID(message ntfy.Message) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\x00%v\x00%v\x00%v", m.room, message.Priority, message.Title, message.Text)
+	if message.Battery != nil {
+		fmt.Fprintf(hash, "\x00%v", message.Battery.Time.UnixNano())
+	} else {
+		fmt.Fprintf(hash, "\x00%v", time.Now().UnixNano())
+	}
+	return "battery_monitor-" + hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+func (m *matrix) sendOnce(ctx context.Context, txnID string, payload []byte) error {
+	endpoint := fmt.Sprintf(
+		"%v/_matrix/client/v3/rooms/%v/send/m.room.message/%v",
+		m.homeserver,
+		url.PathEscape(m.room),
+		url.PathEscape(txnID),
+	)
+	req, err := http.NewRequestWithContext(ctx, "PUT", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("While trying to write to %v: %w", m.homeserver, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("While reading response from matrix: %w", err)
+		}
+		result := responseError{statusCode: resp.StatusCode}
+		if err := json.Unmarshal(respBytes, &result.response); err != nil {
+			result.response.Error = strings.TrimSpace(string(respBytes))
+		}
+		return result
+	}
+	return nil
+}
+
+func (m *matrix) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	logger.Info("Sending to Matrix", zap.String("message", message.Text), zap.String("room", m.room))
+	payload, err := json.Marshal(m.event(message))
+	if err != nil {
+		return err
+	}
+	txnID := m.transactionID(message)
+	delay := m.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := m.sendOnce(ctx, txnID, payload)
+		var respErr responseError
+		if err == nil || attempt >= m.attempts || (errors.As(err, &respErr) && !respErr.temporary()) {
+			return err
+		}
+		if wait := time.Duration(respErr.response.RetryAfterMs) * time.Millisecond; wait > delay {
+			delay = wait
+		}
+		logger.Info("Retrying matrix", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Create returns a sender posting to a room (e.g. !abc:example.org)
+// on the homeserver (e.g. https://matrix.example.org), using the
+// access token of a user who has joined it.
+func Create(homeserver, token, room string, options ...Option) (*matrix, error) {
+	result := &matrix{
+		homeserver: strings.TrimSuffix(homeserver, "/"),
+		token:      token,
+		room:       room,
+		attempts:   1,
+		client:     http.DefaultClient,
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,135 @@
+package matrix
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+const room = "!abc:example.org"
+
+// fakeHomeserver fails the first few attempts to send with the given
+// status, recording the path of each attempt and the last event.
+type fakeHomeserver struct {
+	failures int
+	status   int
+	body     string
+
+	mu       sync.Mutex
+	paths    []string
+	received event
+}
+
+func (f *fakeHomeserver) start(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.Method != "PUT" {
+			t.Errorf("unexpected method %v", r.Method)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization %q", auth)
+		}
+		f.paths = append(f.paths, r.URL.EscapedPath())
+		if len(f.paths) <= f.failures {
+			w.WriteHeader(f.status)
+			w.Write([]byte(f.body))
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&f.received); err != nil {
+			t.Error(err)
+		}
+		w.Write([]byte(`{"event_id": "$YUwRidLecu:example.org"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+var message = ntfy.Message{
+	Title:    "Battery low",
+	Text:     "Plug in soon",
+	Priority: "high",
+	Battery:  &ntfy.Battery{Summary: "15% [Discharging]", Charge: 0.15, State: "Discharging", Time: time.Unix(1700000000, 0)},
+}
+
+func TestSend(t *testing.T) {
+	fake := &fakeHomeserver{}
+	sender, err := Create(fake.start(t)+"/", "secret", room, WithHTML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(context.Background(), zap.NewNop(), message); err != nil {
+		t.Fatal(err)
+	}
+	prefix := "/_matrix/client/v3/rooms/%21abc:example.org/send/m.room.message/battery_monitor-"
+	if len(fake.paths) != 1 || !strings.HasPrefix(fake.paths[0], prefix) {
+		t.Errorf("unexpected paths %v", fake.paths)
+	}
+	if fake.received.MsgType != "m.text" || fake.received.Body != "Battery low\nPlug in soon" {
+		t.Errorf("unexpected event %+v", fake.received)
+	}
+	if !strings.Contains(fake.received.FormattedBody, `<font data-mx-color="#d32f2f"><b>15%</b></font>`) {
+		t.Errorf("unexpected formatted body %q", fake.received.FormattedBody)
+	}
+}
+
+func TestRetriesReuseTransaction(t *testing.T) {
+	fake := &fakeHomeserver{failures: 2, status: http.StatusBadGateway, body: "Bad Gateway"}
+	sender, err := Create(fake.start(t), "secret", room, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(context.Background(), zap.NewNop(), message); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.paths) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", fake.paths)
+	}
+	for _, path := range fake.paths[1:] {
+		if path != fake.paths[0] {
+			t.Errorf("retry used %v rather than %v", path, fake.paths[0])
+		}
+	}
+}
+
+func TestPermanentErrorIsNotRetried(t *testing.T) {
+	fake := &fakeHomeserver{
+		failures: 3,
+		status:   http.StatusForbidden,
+		body:     `{"errcode": "M_FORBIDDEN", "error": "You are not in this room"}`,
+	}
+	sender, err := Create(fake.start(t), "secret", room, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sender.Send(context.Background(), zap.NewNop(), message)
+	if err == nil || err.Error() != "matrix responded with 403: M_FORBIDDEN: You are not in this room" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(fake.paths) != 1 {
+		t.Errorf("expected a single attempt, got %v", fake.paths)
+	}
+}
+
+func TestTransactionID(t *testing.T) {
+	sender, err := Create("https://matrix.example.org", "secret", room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender.transactionID(message) != sender.transactionID(message) {
+		t.Error("the same message should have the same transaction id")
+	}
+	later := message
+	later.Battery = &ntfy.Battery{Time: message.Battery.Time.Add(time.Minute)}
+	if sender.transactionID(message) == sender.transactionID(later) {
+		t.Error("messages about different statuses should have different transaction ids")
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nicois/battery_monitor/power_sources"
+	"go.uber.org/zap"
+)
+
+type MqttConfig struct {
+	Broker          string        `toml:"broker"` // e.g. tcp://homeassistant.local:1883
+	Username        string        `toml:"username"`
+	Password        string        `toml:"password"`
+	ClientID        string        `toml:"client_id"`        // defaults to battery_monitor_<node_id>
+	DiscoveryPrefix string        `toml:"discovery_prefix"` // as configured in Home Assistant
+	TopicPrefix     string        `toml:"topic_prefix"`     // state topics are <topic_prefix>/<node_id>/...
+	NodeID          string        `toml:"node_id"`          // identifies this machine; defaults to the host name
+	Timeout         time.Duration `toml:"timeout"`
+}
+
+func (c *MqttConfig) applyDefaults() {
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "battery_monitor"
+	}
+	if c.NodeID == "" {
+		hostname, _ := os.Hostname()
+		c.NodeID = hostname
+	}
+	c.NodeID = sanitiseNodeID(c.NodeID)
+	if c.ClientID == "" {
+		c.ClientID = "battery_monitor_" + c.NodeID
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+func (c *MqttConfig) Validate() error {
+	if !strings.Contains(c.Broker, "://") {
+		return fmt.Errorf("broker: %q should look like tcp://host:1883", c.Broker)
+	}
+	if c.NodeID == "" {
+		return fmt.Errorf("node_id: must not be empty")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout: %v must be positive", c.Timeout)
+	}
+	return nil
+}
+
+var invalidNodeIDCharacters = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// sanitiseNodeID makes a name usable in MQTT discovery topics,
+// which only allow [a-zA-Z0-9_-].
+func sanitiseNodeID(name string) string {
+	return strings.ToLower(invalidNodeIDCharacters.ReplaceAllString(name, "_"))
+}
+
+// mqttEntity is a sensor announced to Home Assistant.
+type mqttEntity struct {
+	component   string // defaults to sensor
+	object      string // used in topics and the unique id
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+	value       func(status *power_sources.Status) string // "None" means unknown
+}
+
+func formatMqttFloat(value float64, precision int) string {
+	return strconv.FormatFloat(value, 'f', precision, 64)
+}
+
+func mqttEstimate(estimate func() (time.Duration, bool)) string {
+	if remaining, ok := estimate(); ok {
+		return formatMqttFloat(remaining.Minutes(), 0)
+	}
+	return "None"
+}
+
+var mqttEntities = []mqttEntity{
+	{
+		object:      "charge",
+		name:        "Charge",
+		deviceClass: "battery",
+		stateClass:  "measurement",
+		unit:        "%",
+		value: func(status *power_sources.Status) string {
+			return formatMqttFloat(100*status.Charge(), 1)
+		},
+	},
+	{
+		object: "state",
+		name:   "State",
+		value: func(status *power_sources.Status) string {
+			return status.State()
+		},
+	},
+	{
+		object:      "power",
+		name:        "Power",
+		deviceClass: "power",
+		stateClass:  "measurement",
+		unit:        "W",
+		value: func(status *power_sources.Status) string {
+			if power := status.Telemetry().Power; power != nil {
+				return formatMqttFloat(*power, 1)
+			}
+			return "None"
+		},
+	},
+	{
+		object:      "time_to_empty",
+		name:        "Time to empty",
+		deviceClass: "duration",
+		unit:        "min",
+		value: func(status *power_sources.Status) string {
+			return mqttEstimate(status.TimeToEmpty)
+		},
+	},
+	{
+		object:      "time_to_full",
+		name:        "Time to full",
+		deviceClass: "duration",
+		unit:        "min",
+		value: func(status *power_sources.Status) string {
+			return mqttEstimate(status.TimeToFull)
+		},
+	},
+}
+
+// peripheralEntity is a sensor for a device's battery, such as a mouse's.
+func peripheralEntity(peripheral power_sources.Peripheral) mqttEntity {
+	label := peripheral.Label()
+	result := mqttEntity{
+		object: "peripheral_" + entitySlug(label),
+		name:   label + " battery",
+		value: func(status *power_sources.Status) string {
+			for _, p := range status.Peripherals() {
+				if p.Label() != label {
+					continue
+				}
+				if p.Charge != nil {
+					return formatMqttFloat(100**p.Charge, 0)
+				}
+				return p.CapacityLevel
+			}
+			return "None" // disconnected
+		},
+	}
+	if peripheral.Charge != nil {
+		result.deviceClass, result.stateClass, result.unit = "battery", "measurement", "%"
+	}
+	return result
+}
+
+// adapterEntities are the sensors for an external power supply:
+// whether it is connected, and the most power it offers, if known.
+func adapterEntities(adapter power_sources.Adapter) []mqttEntity {
+	name := adapter.Name
+	find := func(status *power_sources.Status) *power_sources.Adapter {
+		for _, a := range status.Adapters() {
+			if a.Name == name {
+				return &a
+			}
+		}
+		return nil
+	}
+	result := []mqttEntity{{
+		component:   "binary_sensor",
+		object:      "adapter_" + entitySlug(name),
+		name:        name,
+		deviceClass: "plug",
+		value: func(status *power_sources.Status) string {
+			if a := find(status); a != nil && a.Online {
+				return "ON"
+			} else if a != nil {
+				return "OFF"
+			}
+			return "None"
+		},
+	}}
+	if adapter.MaxPower != nil {
+		result = append(result, mqttEntity{
+			object:      "adapter_" + entitySlug(name) + "_max_power",
+			name:        name + " max power",
+			deviceClass: "power",
+			stateClass:  "measurement",
+			unit:        "W",
+			value: func(status *power_sources.Status) string {
+				if a := find(status); a != nil && a.MaxPower != nil {
+					return formatMqttFloat(*a.MaxPower, 0)
+				}
+				return "None"
+			},
+		})
+	}
+	return result
+}
+
+// statusEntities are the sensors which depend on what is connected.
+func statusEntities(status *power_sources.Status) []mqttEntity {
+	var result []mqttEntity
+	for _, adapter := range status.Adapters() {
+		result = append(result, adapterEntities(adapter)...)
+	}
+	for _, peripheral := range status.Peripherals() {
+		result = append(result, peripheralEntity(peripheral))
+	}
+	return result
+}
+
+type mqttDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+type mqttDiscovery struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	ObjectID          string     `json:"object_id"`
+	StateTopic        string     `json:"state_topic"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	DeviceClass       string     `json:"device_class,omitempty"`
+	StateClass        string     `json:"state_class,omitempty"`
+	UnitOfMeasurement string     `json:"unit_of_measurement,omitempty"`
+	Device            mqttDevice `json:"device"`
+}
+
+// HaMqtt publishes statuses over MQTT, announcing the sensors using
+// Home Assistant's MQTT discovery so they persist across restarts.
+// The broker marks them unavailable if the connection is lost.
+type HaMqtt struct {
+	config MqttConfig
+	client mqtt.Client
+
+	mu      sync.Mutex
+	device  mqttDevice            // updated from the latest status
+	dynamic map[string]mqttEntity // by object, for each adapter and peripheral seen so far
+}
+
+func (h *HaMqtt) availabilityTopic() string {
+	return fmt.Sprintf("%v/%v/availability", h.config.TopicPrefix, h.config.NodeID)
+}
+
+func (h *HaMqtt) stateTopic(entity mqttEntity) string {
+	return fmt.Sprintf("%v/%v/%v", h.config.TopicPrefix, h.config.NodeID, entity.object)
+}
+
+func (h *HaMqtt) discoveryTopic(entity mqttEntity) string {
+	component := entity.component
+	if component == "" {
+		component = "sensor"
+	}
+	return fmt.Sprintf("%v/%v/%v/%v/config", h.config.DiscoveryPrefix, component, h.config.NodeID, entity.object)
+}
+
+// publish sends a retained message, waiting for it to be acknowledged.
+func (h *HaMqtt) publish(topic string, payload any) error {
+	token := h.client.Publish(topic, 1, true, payload)
+	if !token.WaitTimeout(h.config.Timeout) {
+		return fmt.Errorf("timed out publishing to %v", topic)
+	}
+	return token.Error()
+}
+
+func (h *HaMqtt) announceEntity(entity mqttEntity, device mqttDevice) error {
+	payload, err := json.Marshal(mqttDiscovery{
+		Name:              entity.name,
+		UniqueID:          h.config.NodeID + "_battery_" + entity.object,
+		ObjectID:          h.config.NodeID + "_battery_" + entity.object,
+		StateTopic:        h.stateTopic(entity),
+		AvailabilityTopic: h.availabilityTopic(),
+		DeviceClass:       entity.deviceClass,
+		StateClass:        entity.stateClass,
+		UnitOfMeasurement: entity.unit,
+		Device:            device,
+	})
+	if err != nil {
+		return err
+	}
+	return h.publish(h.discoveryTopic(entity), payload)
+}
+
+// entities returns every sensor, including those for
+// adapters and peripherals, in a consistent order.
+func (h *HaMqtt) entities() []mqttEntity {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := slices.Clone(mqttEntities)
+	objects := make([]string, 0, len(h.dynamic))
+	for object := range h.dynamic {
+		objects = append(objects, object)
+	}
+	slices.Sort(objects)
+	for _, object := range objects {
+		result = append(result, h.dynamic[object])
+	}
+	return result
+}
+
+// announce publishes the discovery configuration and marks the
+// device as available. It is done on every (re)connection, as
+// the broker may have lost its retained messages.
+func (h *HaMqtt) announce() error {
+	h.mu.Lock()
+	device := h.device
+	h.mu.Unlock()
+	for _, entity := range h.entities() {
+		if err := h.announceEntity(entity, device); err != nil {
+			return err
+		}
+	}
+	return h.publish(h.availabilityTopic(), "online")
+}
+
+// Publish sends the state of each sensor, announcing any
+// adapters and peripherals which have not been seen before.
+func (h *HaMqtt) Publish(status *power_sources.Status) error {
+	t := status.Telemetry()
+	h.mu.Lock()
+	changed := h.device.Manufacturer != t.Manufacturer || h.device.Model != t.Model
+	h.device.Manufacturer, h.device.Model = t.Manufacturer, t.Model
+	device := h.device
+	var added []mqttEntity
+	for _, entity := range statusEntities(status) {
+		if _, exists := h.dynamic[entity.object]; !exists {
+			h.dynamic[entity.object] = entity
+			added = append(added, entity)
+		}
+	}
+	h.mu.Unlock()
+	if changed {
+		if err := h.announce(); err != nil {
+			return err
+		}
+	} else {
+		for _, entity := range added {
+			if err := h.announceEntity(entity, device); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entity := range h.entities() {
+		if err := h.publish(h.stateTopic(entity), entity.value(status)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close marks the device as unavailable and disconnects.
+func (h *HaMqtt) Close() {
+	if err := h.publish(h.availabilityTopic(), "offline"); err != nil {
+		logger.Info("unable to mark MQTT sensors unavailable", zap.Error(err))
+	}
+	h.client.Disconnect(uint(h.config.Timeout.Milliseconds()))
+}
+
+// NewHaMqtt connects to the broker. If it is unreachable, connecting
+// carries on in the background. Should the connection be lost, the
+// broker publishes the last will, marking the sensors as unavailable;
+// reconnection is automatic.
+func NewHaMqtt(config MqttConfig) (*HaMqtt, error) {
+	hostname, _ := os.Hostname()
+	result := &HaMqtt{
+		config: config,
+		device: mqttDevice{
+			Identifiers: []string{"battery_monitor_" + config.NodeID},
+			Name:        hostname + " battery",
+		},
+		dynamic: make(map[string]mqttEntity),
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetConnectTimeout(config.Timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(result.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(mqtt.Client) {
+			// this runs on its own goroutine, so it may wait for acknowledgements
+			if err := result.announce(); err != nil {
+				logger.Warn("While announcing MQTT sensors", zap.Error(err))
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warn("Lost MQTT connection", zap.Error(err))
+		})
+	result.client = mqtt.NewClient(options)
+	token := result.client.Connect()
+	if !token.WaitTimeout(config.Timeout) {
+		logger.Warn("Still trying to connect to MQTT broker", zap.String("broker", config.Broker))
+		return result, nil
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("While connecting to %v: %w", config.Broker, err)
+	}
+	return result, nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/command"
+	"github.com/nicois/battery_monitor/desktop"
+	"github.com/nicois/battery_monitor/email"
+	"github.com/nicois/battery_monitor/gotify"
+	"github.com/nicois/battery_monitor/matrix"
+	"github.com/nicois/battery_monitor/ntfy"
+	"github.com/nicois/battery_monitor/pushover"
+	"github.com/nicois/battery_monitor/webhook"
+)
+
+// RouteConfig is common to every kind of sender, deciding
+// which alerts it receives.
+type RouteConfig struct {
+	Name        string        `toml:"name"`         // used when reporting errors
+	MinPriority string        `toml:"min_priority"` // alerts less urgent than this are not sent
+	Timeout     time.Duration `toml:"timeout"`      // how long sending an alert may take
+}
+
+func (r RouteConfig) Validate() error {
+	if r.MinPriority != "" && !slices.Contains(ntfy.Priorities, r.MinPriority) {
+		return fmt.Errorf("min_priority: %q is not one of %v", r.MinPriority, ntfy.Priorities)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("timeout: %v must not be negative", r.Timeout)
+	}
+	return nil
+}
+
+// route is promoted to each sender's configuration.
+func (r *RouteConfig) route() *RouteConfig {
+	return r
+}
+
+func (r *RouteConfig) applyDefaults() {
+	if r.Timeout == 0 {
+		r.Timeout = time.Minute
+	}
+}
+
+// NotifyConfig lists the senders alerts are routed to.
+type NotifyConfig struct {
+	Ntfy     []NtfyConfig     `toml:"ntfy"`
+	Gotify   []GotifyConfig   `toml:"gotify"`
+	Pushover []PushoverConfig `toml:"pushover"`
+	Email    []EmailConfig    `toml:"email"`
+	Webhook  []WebhookConfig  `toml:"webhook"`
+	Matrix   []MatrixConfig   `toml:"matrix"`
+	Desktop  []DesktopConfig  `toml:"desktop"`
+	Command  []CommandConfig  `toml:"command"`
+}
+
+// senderConfig is implemented by the configuration of each kind of sender.
+type senderConfig interface {
+	Validate() error
+	NewSender() (Sender, error)
+	applyDefaults()
+	route() *RouteConfig
+}
+
+type keyedSenderConfig struct {
+	senderConfig
+	key string // where it is in the configuration file
+}
+
+func appendSenderConfigs[T any, PT interface {
+	*T
+	senderConfig
+}](result []keyedSenderConfig, key string, configs []T) []keyedSenderConfig {
+	for i := range configs {
+		result = append(result, keyedSenderConfig{
+			senderConfig: PT(&configs[i]),
+			key:          fmt.Sprintf("%v[%v]", key, i),
+		})
+	}
+	return result
+}
+
+// senderConfigs returns every configured sender.
+func (c *Config) senderConfigs() []keyedSenderConfig {
+	var result []keyedSenderConfig
+	if c.Ntfy.Topic != "" {
+		result = append(result, keyedSenderConfig{senderConfig: &c.Ntfy, key: "ntfy"})
+	}
+	result = appendSenderConfigs(result, "notify.ntfy", c.Notify.Ntfy)
+	result = appendSenderConfigs(result, "notify.gotify", c.Notify.Gotify)
+	result = appendSenderConfigs(result, "notify.pushover", c.Notify.Pushover)
+	result = appendSenderConfigs(result, "notify.email", c.Notify.Email)
+	result = appendSenderConfigs(result, "notify.webhook", c.Notify.Webhook)
+	result = appendSenderConfigs(result, "notify.matrix", c.Notify.Matrix)
+	result = appendSenderConfigs(result, "notify.desktop", c.Notify.Desktop)
+	result = appendSenderConfigs(result, "notify.command", c.Notify.Command)
+	return result
+}
+
+// newSender returns what a sender package's Create function returned,
+// taking care not to wrap a nil pointer in a non-nil Sender.
+func newSender[S Sender](sender S, err error) (Sender, error) {
+	if err != nil {
+		return nil, err
+	}
+	return sender, nil
+}
+
+// NewSender returns a Router sending alerts to every configured sender.
+func (c *Config) NewSender() (*Router, error) {
+	var routes []Route
+	for _, config := range c.senderConfigs() {
+		sender, err := config.NewSender()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", config.key, err)
+		}
+		route := config.route()
+		name := route.Name
+		if name == "" {
+			name = config.key
+		}
+		routes = append(routes, Route{
+			Name:        name,
+			Sender:      sender,
+			MinPriority: route.MinPriority,
+			Timeout:     route.Timeout,
+		})
+	}
+	return NewRouter(routes...), nil
+}
+
+type NtfyConfig struct {
+	RouteConfig
+	Server   string `toml:"server"`
+	Topic    string `toml:"topic"`
+	Token    string `toml:"token"` // access token, for servers requiring authentication
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	JSON     bool   `toml:"json"`  // publish as JSON rather than with headers
+	Click    string `toml:"click"` // URL to open when a notification is clicked
+	Icon     string `toml:"icon"`  // URL of an image to show with notifications
+
+	Attempts     int           `toml:"attempts"`      // how many times to try sending each message
+	RetryDelay   time.Duration `toml:"retry_delay"`   // before the second attempt; it doubles after that
+	Outbox       string        `toml:"outbox"`        // file holding messages which could not be sent yet
+	OutboxExpiry time.Duration `toml:"outbox_expiry"` // messages waiting longer than this are discarded
+}
+
+func (c *NtfyConfig) applyDefaults() {
+	c.RouteConfig.applyDefaults()
+	if c.Server == "" {
+		c.Server = "https://ntfy.sh"
+	}
+	if c.Attempts == 0 {
+		c.Attempts = 4
+	}
+	if c.RetryDelay == 0 {
+		c.RetryDelay = 2 * time.Second
+	}
+	if c.Outbox == "" {
+		// the same topic may be used on several servers
+		server := fnv.New32a()
+		server.Write([]byte(c.Server))
+		c.Outbox = filepath.Join(filepath.Dir(defaultStateFilename()), fmt.Sprintf("ntfy_outbox_%v_%08x.json", c.Topic, server.Sum32()))
+	}
+	if c.OutboxExpiry == 0 {
+		c.OutboxExpiry = 6 * time.Hour
+	}
+}
+
+func (c *NtfyConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	if c.Topic == "" {
+		return fmt.Errorf("topic: you have not defined a topic")
+	}
+	if c.Attempts < 1 {
+		return fmt.Errorf("attempts: %v must be at least 1", c.Attempts)
+	}
+	if c.OutboxExpiry <= 0 {
+		return fmt.Errorf("outbox_expiry: %v must be positive", c.OutboxExpiry)
+	}
+	if c.Token != "" && c.Username != "" {
+		return fmt.Errorf("username: cannot be used together with token")
+	}
+	return nil
+}
+
+// NewSender returns the configured ntfy sender.
+func (c *NtfyConfig) NewSender() (Sender, error) {
+	options := []ntfy.Option{
+		ntfy.WithRetries(c.Attempts, c.RetryDelay),
+		ntfy.WithOutbox(c.Outbox, c.OutboxExpiry),
+	}
+	if c.Token != "" {
+		options = append(options, ntfy.WithToken(c.Token))
+	}
+	if c.Username != "" {
+		options = append(options, ntfy.WithBasicAuth(c.Username, c.Password))
+	}
+	if c.JSON {
+		options = append(options, ntfy.WithJSON)
+	}
+	if c.Click != "" {
+		options = append(options, ntfy.WithClick(c.Click))
+	}
+	if c.Icon != "" {
+		options = append(options, ntfy.WithIcon(c.Icon))
+	}
+	return newSender(ntfy.Create(c.Server, c.Topic, options...))
+}
+
+type GotifyConfig struct {
+	RouteConfig
+	Server string `toml:"server"` // e.g. https://gotify.example.com
+	Token  string `toml:"token"`  // application token
+}
+
+func (c *GotifyConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	if c.Server == "" {
+		return fmt.Errorf("server: must not be empty")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token: must not be empty")
+	}
+	return nil
+}
+
+func (c *GotifyConfig) NewSender() (Sender, error) {
+	return newSender(gotify.Create(c.Server, c.Token))
+}
+
+type PushoverConfig struct {
+	RouteConfig
+	API    string        `toml:"api"`    // defaults to https://api.pushover.net
+	Token  string        `toml:"token"`  // application token
+	User   string        `toml:"user"`   // user or group key
+	Retry  time.Duration `toml:"retry"`  // how often to repeat an emergency ("max") notification
+	Expire time.Duration `toml:"expire"` // when to stop repeating it
+}
+
+func (c *PushoverConfig) applyDefaults() {
+	c.RouteConfig.applyDefaults()
+	if c.API == "" {
+		c.API = pushover.DefaultAPI
+	}
+	if c.Retry == 0 {
+		c.Retry = time.Minute
+	}
+	if c.Expire == 0 {
+		c.Expire = time.Hour
+	}
+}
+
+func (c *PushoverConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token: must not be empty")
+	}
+	if c.User == "" {
+		return fmt.Errorf("user: must not be empty")
+	}
+	_, err := c.NewSender()
+	return err
+}
+
+func (c *PushoverConfig) NewSender() (Sender, error) {
+	return newSender(pushover.Create(
+		c.Token,
+		c.User,
+		pushover.WithAPI(c.API),
+		pushover.WithEmergency(c.Retry, c.Expire),
+	))
+}
+
+type EmailConfig struct {
+	RouteConfig
+	Server   string   `toml:"server"`   // host:port of the SMTP server
+	Security string   `toml:"security"` // "starttls" (the default), "tls" or "none"
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+}
+
+func (c *EmailConfig) applyDefaults() {
+	c.RouteConfig.applyDefaults()
+	if c.Security == "" {
+		c.Security = email.StartTLS
+	}
+}
+
+func (c *EmailConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if c.From == "" {
+		return fmt.Errorf("from: must not be empty")
+	}
+	_, err := c.NewSender()
+	return err
+}
+
+func (c *EmailConfig) NewSender() (Sender, error) {
+	options := []email.Option{email.WithSecurity(c.Security)}
+	if c.Username != "" {
+		options = append(options, email.WithAuth(c.Username, c.Password))
+	}
+	return newSender(email.Create(c.Server, c.From, c.To, options...))
+}
+
+// WebhookConfig describes an arbitrary HTTP request. Each field is
+// a text/template, rendered against a webhook.Context, e.g.
+//
+//	[[notify.webhook]]
+//	url = "https://hooks.slack.com/services/..."
+//	headers = { Content-Type = "application/json" }
+//	body = '{"text": {{json .Text}}}'
+type WebhookConfig struct {
+	RouteConfig
+	Method  string            `toml:"method"` // defaults to POST
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+	Body    string            `toml:"body"` // defaults to the message text
+}
+
+func (c *WebhookConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	_, err := c.NewSender()
+	return err
+}
+
+func (c *WebhookConfig) NewSender() (Sender, error) {
+	return newSender(webhook.Create(webhook.Templates{
+		Method:  c.Method,
+		URL:     c.URL,
+		Headers: c.Headers,
+		Body:    c.Body,
+	}))
+}
+
+type MatrixConfig struct {
+	RouteConfig
+	Homeserver string        `toml:"homeserver"` // e.g. https://matrix.example.org
+	Token      string        `toml:"token"`      // access token of a user in the room
+	Room       string        `toml:"room"`       // room id, e.g. !abc:example.org
+	HTML       bool          `toml:"html"`       // also send formatted messages
+	Attempts   int           `toml:"attempts"`
+	RetryDelay time.Duration `toml:"retry_delay"`
+}
+
+func (c *MatrixConfig) applyDefaults() {
+	c.RouteConfig.applyDefaults()
+	if c.Attempts == 0 {
+		c.Attempts = 4
+	}
+	if c.RetryDelay == 0 {
+		c.RetryDelay = 2 * time.Second
+	}
+}
+
+func (c *MatrixConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	if c.Homeserver == "" {
+		return fmt.Errorf("homeserver: must not be empty")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token: must not be empty")
+	}
+	if !strings.HasPrefix(c.Room, "!") {
+		return fmt.Errorf("room: %q is not a room id (which starts with !)", c.Room)
+	}
+	_, err := c.NewSender()
+	return err
+}
+
+func (c *MatrixConfig) NewSender() (Sender, error) {
+	options := []matrix.Option{matrix.WithRetries(c.Attempts, c.RetryDelay)}
+	if c.HTML {
+		options = append(options, matrix.WithHTML)
+	}
+	return newSender(matrix.Create(c.Homeserver, c.Token, c.Room, options...))
+}
+
+type DesktopConfig struct {
+	RouteConfig
+	AppName string `toml:"app_name"`
+}
+
+func (c *DesktopConfig) NewSender() (Sender, error) {
+	var options []desktop.Option
+	if c.AppName != "" {
+		options = append(options, desktop.WithAppName(c.AppName))
+	}
+	return newSender(desktop.Create(options...))
+}
+
+type CommandConfig struct {
+	RouteConfig
+	Command []string `toml:"command"` // e.g. ["paplay", "/usr/share/sounds/freedesktop/stereo/alarm-clock-elapsed.oga"]
+}
+
+func (c *CommandConfig) Validate() error {
+	if err := c.RouteConfig.Validate(); err != nil {
+		return err
+	}
+	_, err := c.NewSender()
+	return err
+}
+
+func (c *CommandConfig) NewSender() (Sender, error) {
+	// the command is killed if it takes longer than the route's timeout
+	return newSender(command.Create(c.Command, command.WithTimeout(c.Timeout)))
+}
@@ -2,45 +2,368 @@
 package ntfy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// Priorities are the priority names understood by ntfy,
+// from least (1) to most (5) urgent.
+var Priorities = []string{"min", "low", "default", "high", "max"}
+
+// Action is a button shown alongside the notification.
+// See https://docs.ntfy.sh/publish/#action-buttons
+type Action struct {
+	Action string `json:"action"` // "view" or "http"
+	Label  string `json:"label"`
+	URL    string `json:"url"`
+	Clear  bool   `json:"clear,omitempty"` // dismiss the notification once the action is taken
+}
+
 type Message struct {
-	Text    string
-	Headers map[string]string
+	Text     string
+	Title    string
+	Priority string // one of Priorities; empty means "default"
+	Tags     []string
+	Click    string // URL to open when the notification is clicked
+	Icon     string // URL of an image to show with the notification
+	Actions  []Action
+	Markdown bool
+	Headers  map[string]string // any others, sent as they are
+
+	// Battery is what the message is about, if anything. It is
+	// not sent to ntfy, but other senders may make use of it.
+	Battery *Battery
+}
+
+// Battery describes the status of a battery, as already
+// read and estimated by the monitor.
+type Battery struct {
+	Summary     string         `json:"summary"` // e.g. "35% [Discharging]"
+	Charge      float64        `json:"charge"`  // a fraction between 0 and 1
+	State       string         `json:"state"`
+	Time        time.Time      `json:"time"`
+	TimeToEmpty *time.Duration `json:"time_to_empty,omitempty"` // nil if there is no estimate
+	TimeToFull  *time.Duration `json:"time_to_full,omitempty"`
+}
+
+// PriorityLevel converts the priority to ntfy's numeric form,
+// which is 3 if it is not recognised.
+func (m Message) PriorityLevel() int {
+	if idx := slices.Index(Priorities, m.Priority); idx > -1 {
+		return idx + 1
+	}
+	return 3
 }
 
 type ntfy struct {
-	url string
+	server   string
+	topic    string
+	token    string
+	username string
+	password string
+	json     bool
+	click    string
+	icon     string
+	client   *http.Client
+
+	attempts   int
+	retryDelay time.Duration
+	outbox     *outbox
 }
 
-func (n *ntfy) Send(ctx context.Context, logger *zap.Logger, message Message) error {
-	logger.Info("Sending to NTFY", zap.String("message", message.Text), zap.String("headers", fmt.Sprintf("%+v", message.Headers)))
-	req, _ := http.NewRequestWithContext(ctx, "POST", n.url, strings.NewReader(message.Text))
+type Option func(n *ntfy) error
+
+// WithToken authenticates using an access token.
+func WithToken(token string) Option {
+	return func(n *ntfy) error {
+		n.token = token
+		return nil
+	}
+}
+
+// WithBasicAuth authenticates using a username and password.
+func WithBasicAuth(username, password string) Option {
+	return func(n *ntfy) error {
+		n.username = username
+		n.password = password
+		return nil
+	}
+}
+
+// WithClient uses the given HTTP client rather than the default
+// one, which gives up on requests after 30 seconds.
+func WithClient(client *http.Client) Option {
+	return func(n *ntfy) error {
+		n.client = client
+		return nil
+	}
+}
+
+// WithJSON publishes messages as JSON rather than using headers,
+// which allows non-ASCII titles and tags.
+func WithJSON(n *ntfy) error {
+	n.json = true
+	return nil
+}
+
+// WithClick sets the URL to open when a notification is clicked,
+// unless the message has its own.
+func WithClick(url string) Option {
+	return func(n *ntfy) error {
+		n.click = url
+		return nil
+	}
+}
+
+// WithIcon sets the URL of an image to show with each
+// notification, unless the message has its own.
+func WithIcon(url string) Option {
+	return func(n *ntfy) error {
+		n.icon = url
+		return nil
+	}
+}
+
+// WithRetries makes up to the given number of attempts to send
+// each message, doubling the delay between each one.
+func WithRetries(attempts int, initialDelay time.Duration) Option {
+	return func(n *ntfy) error {
+		if attempts < 1 {
+			return fmt.Errorf("at least one attempt is required, not %v", attempts)
+		}
+		n.attempts = attempts
+		n.retryDelay = initialDelay
+		return nil
+	}
+}
+
+// WithOutbox keeps messages which could not be sent in the given
+// file, so they can be sent once the server is reachable again.
+// Messages older than expiry are discarded.
+func WithOutbox(filename string, expiry time.Duration) Option {
+	return func(n *ntfy) error {
+		n.outbox = &outbox{filename: filename, expiry: expiry}
+		return nil
+	}
+}
+
+func (n *ntfy) url() string {
+	return n.server + "/" + n.topic
+}
+
+func formatAction(action Action) string {
+	result := fmt.Sprintf("%v, %v, %v", action.Action, action.Label, action.URL)
+	if action.Clear {
+		result += ", clear=true"
+	}
+	return result
+}
+
+// headerRequest puts everything except the text in headers.
+func (n *ntfy) headerRequest(ctx context.Context, message Message) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url(), strings.NewReader(message.Text))
+	if err != nil {
+		return nil, err
+	}
 	for k, v := range message.Headers {
 		req.Header.Set(k, v)
 	}
-	if resp, err := http.DefaultClient.Do(req); err == nil {
-		if resp.StatusCode >= 400 {
-			defer resp.Body.Close()
-			if body, err := io.ReadAll(resp.Body); err == nil {
-				logger.Info("Got response from ntfy server", zap.Int("response", resp.StatusCode), zap.String("body", string(body)))
-			} else {
-				return fmt.Errorf("While reading response from ntfy: %w", err)
-			}
+	for k, v := range map[string]string{
+		"Title":    message.Title,
+		"Priority": message.Priority,
+		"Tags":     strings.Join(message.Tags, ","),
+		"Click":    message.Click,
+		"Icon":     message.Icon,
+	} {
+		if v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	if len(message.Actions) > 0 {
+		actions := make([]string, len(message.Actions))
+		for i, action := range message.Actions {
+			actions[i] = formatAction(action)
 		}
+		req.Header.Set("Actions", strings.Join(actions, "; "))
+	}
+	if message.Markdown {
+		req.Header.Set("Markdown", "yes")
+	}
+	return req, nil
+}
+
+type jsonMessage struct {
+	Topic    string   `json:"topic"`
+	Message  string   `json:"message"`
+	Title    string   `json:"title,omitempty"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags,omitempty"`
+	Click    string   `json:"click,omitempty"`
+	Icon     string   `json:"icon,omitempty"`
+	Actions  []Action `json:"actions,omitempty"`
+	Markdown bool     `json:"markdown,omitempty"`
+}
+
+// jsonRequest uses the JSON publishing endpoint, which is the server root.
+func (n *ntfy) jsonRequest(ctx context.Context, message Message) (*http.Request, error) {
+	payload, err := json.Marshal(jsonMessage{
+		Topic:    n.topic,
+		Message:  message.Text,
+		Title:    message.Title,
+		Priority: message.PriorityLevel(),
+		Tags:     message.Tags,
+		Click:    message.Click,
+		Icon:     message.Icon,
+		Actions:  message.Actions,
+		Markdown: message.Markdown,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.server, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range message.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// StatusError is returned when the server rejects a message.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("ntfy responded with %v: %v", e.StatusCode, e.Body)
+}
+
+// Permanent is true if trying again will not help.
+func (e StatusError) Permanent() bool {
+	return e.StatusCode < 500 && e.StatusCode != http.StatusRequestTimeout && e.StatusCode != http.StatusTooManyRequests
+}
+
+func isPermanent(err error) bool {
+	var statusError StatusError
+	return errors.As(err, &statusError) && statusError.Permanent()
+}
+
+// sendOnce makes a single attempt to deliver the message.
+func (n *ntfy) sendOnce(ctx context.Context, message Message) error {
+	if message.Click == "" {
+		message.Click = n.click
+	}
+	if message.Icon == "" {
+		message.Icon = n.icon
+	}
+	var req *http.Request
+	var err error
+	if n.json {
+		req, err = n.jsonRequest(ctx, message)
 	} else {
-		return fmt.Errorf("While trying to write %v to %v: %w", message.Headers, n.url, err)
+		req, err = n.headerRequest(ctx, message)
+	}
+	if err != nil {
+		return err
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	} else if n.username != "" {
+		req.SetBasicAuth(n.username, n.password)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("While trying to write to %v: %w", n.url(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("While reading response from ntfy: %w", err)
+		}
+		return StatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(body))}
 	}
 	return nil
 }
 
-func Create(topic string) *ntfy {
-	return &ntfy{url: "https://ntfy.sh/" + topic}
+// sendWithRetries tries to deliver the message, waiting
+// increasingly long between attempts.
+func (n *ntfy) sendWithRetries(ctx context.Context, logger *zap.Logger, message Message) error {
+	delay := n.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := n.sendOnce(ctx, message)
+		if err == nil || isPermanent(err) || attempt >= n.attempts {
+			return err
+		}
+		logger.Info("Retrying ntfy", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// Send delivers the message, retrying if necessary. If it still cannot
+// be delivered, and an outbox has been configured, the message is
+// kept to be sent later, and the returned error wraps ErrQueued.
+// Messages already waiting in the outbox are sent first, to keep
+// them in order.
+func (n *ntfy) Send(ctx context.Context, logger *zap.Logger, message Message) error {
+	logger.Info("Sending to NTFY", zap.String("message", message.Text), zap.String("priority", message.Priority), zap.Strings("tags", message.Tags))
+	var err error
+	if err = n.Flush(ctx, logger); err == nil {
+		err = n.sendWithRetries(ctx, logger, message)
+	}
+	if err == nil || n.outbox == nil || isPermanent(err) {
+		return err
+	}
+	if queueErr := n.outbox.add(logger, message); queueErr != nil {
+		return errors.Join(err, queueErr)
+	}
+	return fmt.Errorf("%w: %w", ErrQueued, err)
+}
+
+// Flush sends any messages waiting in the outbox, stopping at the
+// first one which cannot be delivered.
+func (n *ntfy) Flush(ctx context.Context, logger *zap.Logger) error {
+	if n.outbox == nil {
+		return nil
+	}
+	return n.outbox.drain(logger, func(message Message) error {
+		return n.sendOnce(ctx, message)
+	})
+}
+
+// Create returns a sender publishing to the topic on the given
+// server, such as https://ntfy.sh
+func Create(server, topic string, options ...Option) (*ntfy, error) {
+	result := &ntfy{
+		server:   strings.TrimSuffix(server, "/"),
+		topic:    topic,
+		attempts: 1,
+		// without a timeout, an unresponsive server would hold up
+		// flushing the outbox, and with it the monitor loop
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,95 @@
+package ntfy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nicois/battery_monitor/jsonfile"
+	"go.uber.org/zap"
+)
+
+// ErrQueued indicates a message could not be sent yet, but
+// has been kept in the outbox to be sent later.
+var ErrQueued = errors.New("message queued in outbox")
+
+type queuedMessage struct {
+	Message Message   `json:"message"`
+	Queued  time.Time `json:"queued"`
+}
+
+// outbox is a file holding messages waiting to be sent, oldest first.
+type outbox struct {
+	mu       sync.Mutex
+	filename string
+	expiry   time.Duration
+}
+
+// load returns the queued messages. A file which cannot be decoded,
+// such as one truncated by a crash, is moved aside so that it
+// doesn't stop anything else from being queued.
+func (o *outbox) load(logger *zap.Logger) ([]queuedMessage, error) {
+	var result []queuedMessage
+	data, err := os.ReadFile(o.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		corrupt := o.filename + ".corrupt"
+		logger.Warn("Moving aside unreadable outbox", zap.String("filename", o.filename), zap.String("moved to", corrupt), zap.Error(err))
+		return nil, os.Rename(o.filename, corrupt)
+	}
+	return result, nil
+}
+
+func (o *outbox) save(messages []queuedMessage) error {
+	if len(messages) == 0 {
+		if err := os.Remove(o.filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return jsonfile.Save(o.filename, messages)
+}
+
+func (o *outbox) add(logger *zap.Logger, message Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	messages, err := o.load(logger)
+	if err != nil {
+		return err
+	}
+	return o.save(append(messages, queuedMessage{Message: message, Queued: time.Now()}))
+}
+
+// drain sends the messages in order, discarding any which have expired.
+// It stops at the first failure, keeping that message and any after it.
+func (o *outbox) drain(logger *zap.Logger, send func(Message) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	messages, err := o.load(logger)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	var sendErr error
+	for len(messages) > 0 {
+		next := messages[0]
+		if age := time.Since(next.Queued); age > o.expiry {
+			logger.Info("Discarding expired message", zap.String("message", next.Message.Text), zap.Duration("age", age))
+		} else if sendErr = send(next.Message); sendErr != nil && !isPermanent(sendErr) {
+			break
+		} else if sendErr != nil {
+			logger.Warn("Discarding rejected message", zap.String("message", next.Message.Text), zap.Error(sendErr))
+			sendErr = nil
+		} else {
+			logger.Info("Sent queued message", zap.String("message", next.Message.Text), zap.Time("queued", next.Queued))
+		}
+		messages = messages[1:]
+	}
+	return errors.Join(sendErr, o.save(messages))
+}
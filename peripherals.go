@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/nicois/battery_monitor/power_sources"
+)
+
+type PeripheralsConfig struct {
+	Low      float64  `toml:"low"` // alert once a device's charge falls below this; zero to never alert
+	Priority string   `toml:"priority"`
+	Include  []string `toml:"include"` // batteries (e.g. hidpp_battery_0) to treat as devices even if the kernel does not
+	Exclude  []string `toml:"exclude"` // batteries or models to ignore
+}
+
+func DefaultPeripheralsConfig() PeripheralsConfig {
+	return PeripheralsConfig{Low: 0.15, Priority: "high"}
+}
+
+func (c *PeripheralsConfig) Validate() error {
+	if c.Low < 0 || c.Low > 1 {
+		return fmt.Errorf("low: %v is not between 0 and 1", c.Low)
+	}
+	if !slices.Contains(power_sources.Priorities, c.Priority) {
+		return fmt.Errorf("priority: %q is not one of %v", c.Priority, power_sources.Priorities)
+	}
+	return nil
+}
+
+// Options chooses which batteries are reported as peripherals.
+func (c *PeripheralsConfig) Options() []power_sources.PeripheralOption {
+	return []power_sources.PeripheralOption{
+		power_sources.IncludePeripherals(c.Include...),
+		power_sources.ExcludePeripherals(c.Exclude...),
+	}
+}
+
+var nonSlugCharacters = regexp.MustCompile(`[^a-z0-9]+`)
+
+// entitySlug turns a name such as "MX Master 3" into
+// something usable in an entity id, such as mx_master_3.
+func entitySlug(name string) string {
+	return strings.Trim(nonSlugCharacters.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
+// peripheralSensor is the Home Assistant entity a
+// peripheral's battery is published to.
+func peripheralSensor(peripheral power_sources.Peripheral) string {
+	return "sensor." + entitySlug(peripheral.Label()) + "_battery"
+}
+
+// peripheralRecharged is how far above the low threshold a
+// device's charge must rise before it is alerted about again.
+const peripheralRecharged = 0.1
+
+// PeripheralWatch alerts when the battery of a device such
+// as a mouse or headset is low, once each time it runs down. Each
+// alert is returned by Update until it is marked as Alerted.
+type PeripheralWatch struct {
+	config  PeripheralsConfig
+	alerted map[string]bool // by label
+}
+
+func NewPeripheralWatch(config PeripheralsConfig) *PeripheralWatch {
+	return &PeripheralWatch{config: config, alerted: make(map[string]bool)}
+}
+
+// PeripheralAlert is an alert about the device with the given label.
+type PeripheralAlert struct {
+	power_sources.Alert
+	Label string
+}
+
+func (w *PeripheralWatch) Update(status *power_sources.Status) []PeripheralAlert {
+	var result []PeripheralAlert
+	for _, peripheral := range status.Peripherals() {
+		label := peripheral.Label()
+		if peripheral.State == "Charging" || !peripheral.Low(w.config.Low+peripheralRecharged) {
+			delete(w.alerted, label)
+			continue
+		}
+		if w.alerted[label] || !peripheral.Low(w.config.Low) {
+			continue
+		}
+		result = append(result, PeripheralAlert{Label: label, Alert: power_sources.Alert{
+			Rule:     "peripheral-low",
+			Priority: w.config.Priority,
+			Title:    label + " battery is low",
+			Message:  fmt.Sprintf("%v needs charging", peripheral),
+			Tags:     []string{"battery"},
+		}})
+	}
+	return result
+}
+
+// Alerted records that the alert about the device was delivered.
+func (w *PeripheralWatch) Alerted(label string) {
+	w.alerted[label] = true
+}
@@ -0,0 +1,140 @@
+package power_sources
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Adapter describes a source of external power, such as
+// a mains adapter or a USB-C charger.
+type Adapter struct {
+	Name     string
+	Online   bool
+	Type     string   // e.g. "Mains" or "USB"
+	USBType  string   // the negotiated USB protocol, e.g. "PD"
+	Voltage  *float64 // V
+	Current  *float64 // A
+	MaxPower *float64 // W, the most the charger has offered
+}
+
+func (a Adapter) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", a.Name)
+	enc.AddBool("online", a.Online)
+	addStrings(enc, map[string]string{"type": a.Type, "usb type": a.USBType})
+	addFloats(enc, map[string]*float64{"voltage": a.Voltage, "current": a.Current, "max power": a.MaxPower})
+	return nil
+}
+
+type adapters []Adapter
+
+func (a adapters) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, adapter := range a {
+		if err := enc.AppendObject(adapter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adapterPatterns match the power supplies which are not batteries.
+// USB-C ports managed by UCSI each have their own.
+var adapterPatterns = []string{"AC*", "ADP*", "ucsi-source-psy-*"}
+
+// activeUSBType picks the selected protocol from a list such as "C [PD] PD_PPS".
+var activeUSBType = regexp.MustCompile(`\[(\S+)\]`)
+
+func readAttribute(path, name string) string {
+	value, err := os.ReadFile(filepath.Join(path, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// readMicros reads an attribute given in µV or µA.
+func readMicros(path, name string) *float64 {
+	value, err := strconv.ParseFloat(readAttribute(path, name), 64)
+	if err != nil {
+		return nil
+	}
+	value *= 1e-6
+	return &value
+}
+
+// readAdapter reads an adapter's sysfs attributes, which are in µV and µA.
+func readAdapter(path string) Adapter {
+	result := Adapter{
+		Name:    filepath.Base(path),
+		Online:  readAttribute(path, "online") == "1",
+		Type:    readAttribute(path, "type"),
+		Voltage: readMicros(path, "voltage_now"),
+		Current: readMicros(path, "current_now"),
+	}
+	if match := activeUSBType.FindStringSubmatch(readAttribute(path, "usb_type")); match != nil {
+		result.USBType = match[1]
+	}
+	voltage, current := readMicros(path, "voltage_max"), readMicros(path, "current_max")
+	if voltage != nil && current != nil && *voltage**current > 0 {
+		power := *voltage * *current
+		result.MaxPower = &power
+	}
+	return result
+}
+
+// withAdapters adds the state of any adapters to each status.
+type withAdapters struct {
+	PowerSource
+	paths []string
+}
+
+// WithAdapters reports the state of any external power supplies
+// along with the power source's status. If there are none,
+// the power source is returned as it is.
+func WithAdapters(p PowerSource) PowerSource {
+	var paths []string
+	for _, pattern := range adapterPatterns {
+		paths = append(paths, Must(filepath.Glob(filepath.Join(powerSupplyDir, pattern)))...)
+	}
+	if len(paths) == 0 {
+		return p
+	}
+	logger.Debug("found adapters", zap.Strings("paths", paths))
+	return &withAdapters{PowerSource: p, paths: paths}
+}
+
+func (w *withAdapters) GetStatus(ctx context.Context) (*Status, error) {
+	status, err := w.PowerSource.GetStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range w.paths {
+		status.adapters = append(status.adapters, readAdapter(path))
+	}
+	return status, nil
+}
+
+func (w *withAdapters) Unwrap() PowerSource {
+	return w.PowerSource
+}
+
+// ChargeControlOf returns the power source's charge control,
+// looking through any wrappers such as WithAdapters.
+func ChargeControlOf(p PowerSource) (ChargeControl, bool) {
+	for {
+		if control, ok := p.(ChargeControl); ok {
+			return control, true
+		}
+		wrapper, ok := p.(interface{ Unwrap() PowerSource })
+		if !ok {
+			return nil, false
+		}
+		p = wrapper.Unwrap()
+	}
+}
@@ -2,6 +2,7 @@ package power_sources
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
@@ -15,58 +16,11 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-type NormalAlerter struct {
-	lastStatus Status
-}
-
 type PowerSource interface {
 	GetStatus(ctx context.Context) (*Status, error)
 }
 
-func (a NormalAlerter) ShouldAlert(logger *zap.Logger, newStatus *Status) (bool, string) {
-	logger.Debug("checking", zap.Object("new", *newStatus), zap.Object("previous", a.lastStatus))
-	if newStatus.state == a.lastStatus.state && newStatus.charge >= a.lastStatus.charge &&
-		newStatus.charge < 0.80 {
-		return false, ""
-	}
-	if newStatus.charge*1.05 <= a.lastStatus.charge {
-		if newStatus.charge < 0.40 {
-			return true, "max"
-		}
-		if newStatus.charge < 0.45 {
-			return true, "high"
-		}
-		if newStatus.charge < 0.50 {
-			return true, "default"
-		}
-		if newStatus.charge < 0.60 {
-			return true, "low"
-		}
-		if newStatus.charge < 0.80 {
-			return false, "min"
-		}
-	}
-	if newStatus.charge >= a.lastStatus.charge+.1 {
-		return true, "min"
-	}
-	if newStatus.charge >= 0.80 && a.lastStatus.charge < 0.80 {
-		return true, "default"
-	}
-	if newStatus.timestamp.Sub(a.lastStatus.timestamp) >= time.Hour*4 {
-		if newStatus.charge > 0.80 {
-			return true, "default"
-		}
-	}
-	return false, ""
-}
-
-func (a *NormalAlerter) Alerted(status Status) {
-	a.lastStatus = status
-}
-
-func CreateNormalAlerter(initialStatus Status) *NormalAlerter {
-	return &NormalAlerter{lastStatus: initialStatus}
-}
+const powerSupplyDir = "/sys/class/power_supply"
 
 type battery struct {
 	path    string
@@ -74,6 +28,26 @@ type battery struct {
 	flavour string
 }
 
+func (b battery) name() string {
+	return filepath.Base(b.path)
+}
+
+// openBattery returns the battery at the given sysfs path,
+// provided its full level can be read.
+func openBattery(path string) (*battery, error) {
+	var err error
+	b := &battery{path: path}
+	for _, potentialFlavour := range []string{"energy", "charge"} {
+		b.flavour = potentialFlavour
+		var total float64
+		if total, err = b.getFullLevel(); err == nil {
+			b.total = total
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
 func NewBattery() PowerSource {
 	mb := &macBattery{}
 	if _, err := mb.GetStatus(context.Background()); err == nil {
@@ -81,31 +55,90 @@ func NewBattery() PowerSource {
 	} else {
 		fmt.Printf("mac error: %v\n", err)
 	}
-	bats := Must(filepath.Glob("/sys/class/power_supply/BAT*"))
-	for _, bat := range bats {
-		b := &battery{path: bat}
-		for _, potentialFlavour := range []string{"energy", "charge"} {
-			b.flavour = potentialFlavour
-			if total, err := b.getFullLevel(); err == nil {
-				b.total = total
-				return b
-			}
+	var batteries []*battery
+	for _, path := range Must(filepath.Glob(powerSupplyDir + "/BAT*")) {
+		if b, err := openBattery(path); err == nil {
+			batteries = append(batteries, b)
+		} else {
+			logger.Info("ignoring battery", zap.String("path", path), zap.Error(err))
 		}
 	}
-
-	panic("Could not read the battery level")
+	switch len(batteries) {
+	case 0:
+		panic("Could not read the battery level")
+	case 1:
+		return batteries[0]
+	default:
+		return &batteryPack{batteries: batteries}
+	}
 }
 
 type Status struct {
+	name      string // which battery this describes, if known
 	charge    float64
 	state     string
 	timestamp time.Time
+	parts     []Status // the individual batteries making up this one, if any
+	telemetry Telemetry
+	// the firmware's charging limits, if it has any
+	thresholds ChargeThresholds
+	// external power supplies, if they are being monitored
+	adapters []Adapter
+	// batteries of devices such as mice, if they are being monitored
+	peripherals []Peripheral
+	// estimates, as annotated by an Estimator
+	timeToEmpty *time.Duration
+	timeToFull  *time.Duration
 }
 
 func (s Status) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if s.name != "" {
+		enc.AddString("name", s.name)
+	}
 	enc.AddFloat64("charge", s.charge)
 	enc.AddString("state", s.state)
 	enc.AddTime("timestamp", s.timestamp)
+	if s.timeToEmpty != nil {
+		enc.AddDuration("time to empty", *s.timeToEmpty)
+	}
+	if s.timeToFull != nil {
+		enc.AddDuration("time to full", *s.timeToFull)
+	}
+	if s.thresholds.End != nil {
+		if err := enc.AddObject("thresholds", s.thresholds); err != nil {
+			return err
+		}
+	}
+	if len(s.adapters) > 0 {
+		if err := enc.AddArray("adapters", adapters(s.adapters)); err != nil {
+			return err
+		}
+	}
+	if len(s.peripherals) > 0 {
+		if err := enc.AddArray("peripherals", peripherals(s.peripherals)); err != nil {
+			return err
+		}
+	}
+	return enc.AddObject("telemetry", s.telemetry)
+}
+
+type statusJSON struct {
+	Name      string    `json:"name,omitempty"`
+	Charge    float64   `json:"charge"`
+	State     string    `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statusJSON{Name: s.name, Charge: s.charge, State: s.state, Timestamp: s.timestamp})
+}
+
+func (s *Status) UnmarshalJSON(data []byte) error {
+	var decoded statusJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	s.name, s.charge, s.state, s.timestamp = decoded.Name, decoded.Charge, decoded.State, decoded.Timestamp
 	return nil
 }
 
@@ -113,10 +146,94 @@ func (s Status) String() string {
 	return fmt.Sprintf("%.0f%% [%v]", s.charge*100, s.state)
 }
 
+func (s Status) Name() string {
+	return s.name
+}
+
+// Parts returns the status of each battery which was combined
+// to produce this one. It is empty for a single battery.
+func (s Status) Parts() []Status {
+	return s.parts
+}
+
+func (s Status) Telemetry() Telemetry {
+	return s.telemetry
+}
+
+// ChargeThresholds returns the firmware's charging limits. Its
+// fields are nil if the battery doesn't support them.
+func (s Status) ChargeThresholds() ChargeThresholds {
+	return s.thresholds
+}
+
+// Adapters returns the state of each external power supply.
+// It is empty unless the power source was created WithAdapters.
+func (s Status) Adapters() []Adapter {
+	return s.adapters
+}
+
+// OnlineAdapters returns the external power supplies which
+// are currently connected.
+func (s Status) OnlineAdapters() []Adapter {
+	var result []Adapter
+	for _, adapter := range s.adapters {
+		if adapter.Online {
+			result = append(result, adapter)
+		}
+	}
+	return result
+}
+
+// Peripherals returns the batteries of connected devices. It is
+// empty unless the power source was created WithPeripherals.
+func (s Status) Peripherals() []Peripheral {
+	return s.peripherals
+}
+
+// TimeToEmpty returns how long until the battery is expected to
+// be empty, if it is discharging and an estimate has been made.
+func (s Status) TimeToEmpty() (time.Duration, bool) {
+	if s.timeToEmpty == nil {
+		return 0, false
+	}
+	return *s.timeToEmpty, true
+}
+
+// TimeToFull returns how long until the battery is expected to
+// be full, if it is charging and an estimate has been made.
+func (s Status) TimeToFull() (time.Duration, bool) {
+	if s.timeToFull == nil {
+		return 0, false
+	}
+	return *s.timeToFull, true
+}
+
+// FormatDuration gives a concise representation of an
+// estimate, such as "2h15m".
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	if d < time.Hour {
+		return fmt.Sprintf("%vm", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%vh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
+
 func (s Status) State() string {
 	return s.state
 }
 
+// ExternalPower is true if the state shows the battery is plugged
+// in, whether or not it is charging, on Linux or macOS.
+func (s Status) ExternalPower() bool {
+	return externalPower(s.state)
+}
+
+// Discharging is true if the state shows the battery is
+// running the machine, on Linux or macOS.
+func (s Status) Discharging() bool {
+	return direction(s.state) < 0
+}
+
 func (s Status) Charge() float64 {
 	return s.charge
 }
@@ -125,40 +242,60 @@ func (s Status) Time() time.Time {
 	return s.timestamp
 }
 
-func (b battery) getFullLevel() (float64, error) {
-	byteValue, err := os.ReadFile(
-		fmt.Sprintf("%v/%v_full_design", b.path, b.flavour),
-	)
+func (b battery) readFloat(name string) (float64, error) {
+	byteValue, err := os.ReadFile(filepath.Join(b.path, name))
 	if err == nil {
 		return strconv.ParseFloat(strings.TrimSpace(string(byteValue)), 64)
 	}
 	return 0, err
 }
 
+func (b battery) getFullLevel() (float64, error) {
+	return b.readFloat(b.flavour + "_full_design")
+}
+
 func (b battery) getCurrentLevel() (float64, error) {
-	byteValue, err := os.ReadFile(fmt.Sprintf("%v/%v_now", b.path, b.flavour))
-	if err == nil {
-		return strconv.ParseFloat(strings.TrimSpace(string(byteValue)), 64)
+	return b.readFloat(b.flavour + "_now")
+}
+
+// getLastFullLevel returns the level the battery last reached when
+// fully charged, which falls as it wears. If the driver doesn't
+// report it, the design level is used instead.
+func (b battery) getLastFullLevel() float64 {
+	if full, err := b.readFloat(b.flavour + "_full"); err == nil && full > 0 {
+		return full
 	}
-	return 0, err
+	return b.total
 }
 
-func (b *battery) GetStatus(ctx context.Context) (*Status, error) {
-	result := &Status{charge: -1, state: "", timestamp: time.Now()}
+// readStatus reads everything but the charge.
+func (b *battery) readStatus() *Status {
+	result := &Status{name: b.name(), charge: -1, state: "", timestamp: time.Now()}
 	if status, err := os.ReadFile(fmt.Sprintf("%v/status", b.path)); err == nil {
 		result.state = strings.TrimSpace(string(status))
 	}
+	result.telemetry = b.getTelemetry()
+	if thresholds, err := b.ChargeThresholds(); err == nil {
+		result.thresholds = thresholds
+	}
+	return result
+}
 
+// GetStatus reports the charge relative to what the battery last held
+// when full, as the kernel's capacity attribute, the firmware's charge
+// thresholds and macOS do. A worn battery still reaches a charge of 1;
+// how worn it is shows in the telemetry's Health.
+func (b *battery) GetStatus(ctx context.Context) (*Status, error) {
+	result := b.readStatus()
 	if currentLevel, err := b.getCurrentLevel(); err == nil {
 		if currentLevel > 0 {
-			result.charge = currentLevel / b.total
+			result.charge = currentLevel / b.getLastFullLevel()
 		} else {
 			return nil, fmt.Errorf("Zero charge!")
 		}
 	} else {
 		return nil, err
 	}
-
 	return result, nil
 }
 
@@ -184,5 +321,10 @@ func (b *macBattery) GetStatus(ctx context.Context) (*Status, error) {
 
 	}
 	result := Status{timestamp: time.Now(), state: matches[1], charge: charge / 100}
+	if telemetry, err := getMacTelemetry(); err == nil {
+		result.telemetry = telemetry
+	} else {
+		logger.Debug("could not read battery telemetry", zap.Error(err))
+	}
 	return &result, nil
 }
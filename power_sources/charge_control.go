@@ -0,0 +1,161 @@
+package power_sources
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// ChargeThresholds are the firmware's charging limits, as fractions.
+// Charging starts once the charge falls below Start, and stops once it
+// reaches End. A nil field is not supported, or is left unchanged.
+type ChargeThresholds struct {
+	Start *float64 `json:"start,omitempty"`
+	End   *float64 `json:"end,omitempty"`
+}
+
+func (t ChargeThresholds) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	if t.Start != nil {
+		enc.AddFloat64("start", *t.Start)
+	}
+	if t.End != nil {
+		enc.AddFloat64("end", *t.End)
+	}
+	return nil
+}
+
+func (t ChargeThresholds) String() string {
+	format := func(threshold *float64) string {
+		if threshold == nil {
+			return "?"
+		}
+		return fmt.Sprintf("%.0f%%", *threshold*100)
+	}
+	return format(t.Start) + "-" + format(t.End)
+}
+
+// Validate returns an error if the thresholds do not make sense.
+func (t ChargeThresholds) Validate() error {
+	for name, threshold := range map[string]*float64{"start": t.Start, "end": t.End} {
+		if threshold != nil && (*threshold < 0 || *threshold > 1) {
+			return fmt.Errorf("%v: %v is not between 0 and 1", name, *threshold)
+		}
+	}
+	if t.Start != nil && t.End != nil && *t.Start >= *t.End {
+		return fmt.Errorf("start: %v must be less than end (%v)", *t.Start, *t.End)
+	}
+	return nil
+}
+
+// ChargeControl is implemented by power sources whose firmware can be
+// told when to start and stop charging. Setting the thresholds usually
+// needs root, or a udev rule making the sysfs attributes writable.
+type ChargeControl interface {
+	ChargeThresholds() (ChargeThresholds, error)
+	SetChargeThresholds(ChargeThresholds) error
+}
+
+const (
+	startThresholdFile = "charge_control_start_threshold"
+	endThresholdFile   = "charge_control_end_threshold"
+)
+
+// ChargeThresholds reads the thresholds, which sysfs gives as percentages.
+func (b battery) ChargeThresholds() (ChargeThresholds, error) {
+	var result ChargeThresholds
+	if start, err := b.readFloat(startThresholdFile); err == nil {
+		start /= 100
+		result.Start = &start
+	}
+	end, err := b.readFloat(endThresholdFile)
+	if err != nil {
+		return result, fmt.Errorf("While reading the charge thresholds of %v: %w", b.name(), err)
+	}
+	end /= 100
+	result.End = &end
+	return result, nil
+}
+
+func (b battery) writeThreshold(name string, threshold float64) error {
+	value := strconv.Itoa(int(math.Round(threshold * 100)))
+	if err := os.WriteFile(filepath.Join(b.path, name), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("While setting %v of %v: %w", name, b.name(), err)
+	}
+	return nil
+}
+
+// SetChargeThresholds writes whichever thresholds are set. As drivers
+// may reject a start threshold beyond the end one, even in passing,
+// they are written in whichever order avoids that.
+func (b battery) SetChargeThresholds(thresholds ChargeThresholds) error {
+	if err := thresholds.Validate(); err != nil {
+		return err
+	}
+	current, err := b.ChargeThresholds()
+	if err != nil {
+		return err
+	}
+	if thresholds.Start != nil && current.Start == nil {
+		return fmt.Errorf("%v does not support a start threshold", b.name())
+	}
+	writeStart := func() error {
+		if thresholds.Start == nil {
+			return nil
+		}
+		return b.writeThreshold(startThresholdFile, *thresholds.Start)
+	}
+	writeEnd := func() error {
+		if thresholds.End == nil {
+			return nil
+		}
+		return b.writeThreshold(endThresholdFile, *thresholds.End)
+	}
+	first, second := writeStart, writeEnd
+	if thresholds.End != nil && *thresholds.End > *current.End {
+		// raising the end threshold first makes room for the start one
+		first, second = writeEnd, writeStart
+	}
+	if err := first(); err != nil {
+		return err
+	}
+	return second()
+}
+
+// ChargeThresholds returns the thresholds of the first battery
+// supporting them.
+func (p *batteryPack) ChargeThresholds() (ChargeThresholds, error) {
+	var errs []error
+	for _, b := range p.batteries {
+		thresholds, err := b.ChargeThresholds()
+		if err == nil {
+			return thresholds, nil
+		}
+		errs = append(errs, err)
+	}
+	return ChargeThresholds{}, errors.Join(errs...)
+}
+
+// SetChargeThresholds sets the thresholds of every battery supporting them.
+func (p *batteryPack) SetChargeThresholds(thresholds ChargeThresholds) error {
+	var errs []error
+	supported := false
+	for _, b := range p.batteries {
+		if _, err := b.ChargeThresholds(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		supported = true
+		if err := b.SetChargeThresholds(thresholds); err != nil {
+			return err
+		}
+	}
+	if !supported {
+		return errors.Join(errs...)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package power_sources
+
+import (
+	"math"
+	"time"
+)
+
+// maxEstimate is the longest estimate worth reporting; anything
+// longer means the charge is effectively not changing.
+const maxEstimate = 48 * time.Hour
+
+// Estimator predicts how long until the battery is empty or full,
+// based on the statuses seen over a sliding window.
+type Estimator struct {
+	window  time.Duration
+	samples []Status
+}
+
+func NewEstimator(window time.Duration) *Estimator {
+	return &Estimator{window: window}
+}
+
+// direction is -1 if the state indicates discharging, 1 if it
+// indicates charging, or 0 if it is not known.
+func direction(state string) float64 {
+	switch state {
+	case "Discharging", "Battery Power":
+		return -1
+	case "Charging":
+		return 1
+	}
+	return 0
+}
+
+// externalPower is true if the state indicates the battery is
+// plugged in, whether or not it is actually charging.
+func externalPower(state string) bool {
+	switch state {
+	case "Charging", "Full", "Not charging", "AC Power":
+		return true
+	}
+	return false
+}
+
+// Add records the status, and annotates it with
+// the time until it is expected to be empty or full.
+func (e *Estimator) Add(status *Status) {
+	if n := len(e.samples); n > 0 && e.samples[n-1].state != status.state {
+		// the rate from a different state is no guide to the new one
+		e.samples = e.samples[:0]
+	}
+	e.samples = append(e.samples, *status)
+	cutoff := status.timestamp.Add(-e.window)
+	for len(e.samples) > 1 && e.samples[0].timestamp.Before(cutoff) {
+		e.samples = e.samples[1:]
+	}
+	status.timeToEmpty, status.timeToFull = nil, nil
+	rate, ok := e.Rate()
+	if !ok || rate == 0 {
+		return
+	}
+	var remaining time.Duration
+	if rate < 0 {
+		remaining = time.Duration(status.charge / -rate * float64(time.Hour))
+	} else {
+		remaining = time.Duration((1 - status.charge) / rate * float64(time.Hour))
+	}
+	if remaining > maxEstimate || remaining < 0 {
+		return
+	}
+	if rate < 0 {
+		status.timeToEmpty = &remaining
+	} else {
+		status.timeToFull = &remaining
+	}
+}
+
+// Rate returns how quickly the charge is changing, as a fraction
+// per hour. It is negative when discharging.
+func (e *Estimator) Rate() (float64, bool) {
+	if len(e.samples) == 0 {
+		return 0, false
+	}
+	if rate, ok := e.powerRate(); ok {
+		return rate, true
+	}
+	return e.chargeRate()
+}
+
+// powerRate uses the average reported power, which reacts much more
+// quickly than the charge does. The state tells which way it flows.
+func (e *Estimator) powerRate() (float64, bool) {
+	var total float64
+	var count int
+	for _, sample := range e.samples {
+		t := sample.telemetry
+		if t.Power == nil || t.Capacity == nil || *t.Capacity <= 0 {
+			continue
+		}
+		total += *t.Power / *t.Capacity
+		count++
+	}
+	latest := e.samples[len(e.samples)-1]
+	sign := direction(latest.state)
+	if count == 0 || sign == 0 {
+		return 0, false
+	}
+	return sign * total / float64(count), true
+}
+
+// chargeRate fits a line through the charges in the window,
+// which smooths out the coarse steps some batteries report in.
+func (e *Estimator) chargeRate() (float64, bool) {
+	if len(e.samples) < 2 {
+		return 0, false
+	}
+	start := e.samples[0].timestamp
+	var sumT, sumC float64
+	for _, sample := range e.samples {
+		sumT += sample.timestamp.Sub(start).Hours()
+		sumC += sample.charge
+	}
+	n := float64(len(e.samples))
+	meanT, meanC := sumT/n, sumC/n
+	var covariance, variance float64
+	for _, sample := range e.samples {
+		dt := sample.timestamp.Sub(start).Hours() - meanT
+		covariance += dt * (sample.charge - meanC)
+		variance += dt * dt
+	}
+	if variance == 0 {
+		return 0, false
+	}
+	rate := covariance / variance
+	if sign := direction(e.samples[len(e.samples)-1].state); sign != 0 && math.Signbit(rate) != math.Signbit(sign) {
+		// the charge is moving the wrong way for the state; it is probably noise
+		return 0, false
+	}
+	return rate, true
+}
@@ -0,0 +1,123 @@
+package power_sources
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateWithoutSamples(t *testing.T) {
+	if rate, ok := NewEstimator(time.Hour).Rate(); ok {
+		t.Errorf("expected no rate, got %v", rate)
+	}
+}
+
+func TestEstimates(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	power := func(watts float64) Telemetry {
+		capacity := 50.0
+		return Telemetry{Power: &watts, Capacity: &capacity}
+	}
+	for name, test := range map[string]struct {
+		state     string
+		charges   []float64 // one sample every 10 minutes
+		telemetry Telemetry
+		rate      float64 // expected per hour; 0 for none
+		empty     time.Duration
+		full      time.Duration
+	}{
+		"discharging by charge": {
+			state:   "Discharging",
+			charges: []float64{0.6, 0.58, 0.56, 0.54},
+			rate:    -0.12,
+			empty:   270 * time.Minute,
+		},
+		"charging by charge": {
+			state:   "Charging",
+			charges: []float64{0.5, 0.55, 0.6},
+			rate:    0.3,
+			full:    80 * time.Minute,
+		},
+		"single sample": {
+			state:   "Discharging",
+			charges: []float64{0.5},
+		},
+		"moving the wrong way": {
+			state:   "Charging",
+			charges: []float64{0.5, 0.49, 0.48},
+		},
+		"unknown state": {
+			state:   "Unknown",
+			charges: []float64{0.5, 0.49, 0.48},
+			rate:    -0.06,
+			empty:   480 * time.Minute,
+		},
+		"discharging by power": {
+			state:     "Discharging",
+			charges:   []float64{0.5, 0.5},
+			telemetry: power(10),
+			rate:      -0.2,
+			empty:     150 * time.Minute,
+		},
+		"charging by power": {
+			state:     "Charging",
+			charges:   []float64{0.5},
+			telemetry: power(25),
+			rate:      0.5,
+			full:      time.Hour,
+		},
+		"power without a direction": {
+			state:     "Unknown",
+			charges:   []float64{0.5},
+			telemetry: power(10),
+		},
+		"too slow to estimate": {
+			state:     "Discharging",
+			charges:   []float64{0.5},
+			telemetry: power(0.1),
+			rate:      -0.002,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			e := NewEstimator(time.Hour)
+			var status Status
+			for i, charge := range test.charges {
+				status = Status{
+					charge:    charge,
+					state:     test.state,
+					timestamp: start.Add(time.Duration(i) * 10 * time.Minute),
+					telemetry: test.telemetry,
+				}
+				e.Add(&status)
+			}
+			rate, ok := e.Rate()
+			if ok != (test.rate != 0) || math.Abs(rate-test.rate) > 1e-9 {
+				t.Errorf("Rate() = %v, %v; expected %v", rate, ok, test.rate)
+			}
+			for label, estimate := range map[string]struct {
+				actual   func() (time.Duration, bool)
+				expected time.Duration
+			}{
+				"TimeToEmpty": {status.TimeToEmpty, test.empty},
+				"TimeToFull":  {status.TimeToFull, test.full},
+			} {
+				remaining, ok := estimate.actual()
+				if ok != (estimate.expected != 0) || (remaining-estimate.expected).Abs() > time.Second {
+					t.Errorf("%v() = %v, %v; expected %v", label, remaining, ok, estimate.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestStateChangeDiscardsSamples(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	e := NewEstimator(time.Hour)
+	for i, charge := range []float64{0.6, 0.5, 0.4} {
+		e.Add(&Status{charge: charge, state: "Discharging", timestamp: start.Add(time.Duration(i) * 10 * time.Minute)})
+	}
+	e.Add(&Status{charge: 0.4, state: "Charging", timestamp: start.Add(30 * time.Minute)})
+	if rate, ok := e.Rate(); ok {
+		t.Errorf("expected no rate from a single charging sample, got %v", rate)
+	}
+}
@@ -0,0 +1,109 @@
+package power_sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// batteryPack combines several batteries, such as the internal and
+// removable batteries found in some laptops, into a single PowerSource.
+type batteryPack struct {
+	batteries []*battery
+}
+
+// energy returns the given level of the battery in µWh. Batteries
+// reporting charge (µAh) are converted using their voltage, so that
+// they can be combined with batteries reporting energy.
+func (b battery) energy(level float64) (float64, error) {
+	if b.flavour == "energy" {
+		return level, nil
+	}
+	voltage, err := b.readFloat("voltage_min_design")
+	if err != nil || voltage <= 0 {
+		if voltage, err = b.readFloat("voltage_now"); err != nil {
+			return 0, err
+		}
+	}
+	return level * voltage / 1e6, nil
+}
+
+// combinedState summarises the states of several batteries. Charging
+// takes precedence, as it indicates external power is present.
+func combinedState(parts []Status) string {
+	result := ""
+	for _, part := range parts {
+		switch {
+		case part.state == "Charging":
+			return part.state
+		case part.state == "Discharging":
+			result = part.state
+		case result == "":
+			result = part.state
+		case result != part.state && result != "Discharging":
+			result = "Unknown"
+		}
+	}
+	return result
+}
+
+// GetStatus sums the energy of the batteries, relative to what they
+// last held when full, just as a single battery's charge is. A battery
+// which is empty still counts towards the total, so that it drags the
+// combined charge down. Batteries which can't be read are left out,
+// provided at least one can be.
+func (p *batteryPack) GetStatus(ctx context.Context) (*Status, error) {
+	result := &Status{timestamp: time.Now()}
+	var now, full float64
+	var errs []error
+	for _, b := range p.batteries {
+		level, err := b.getCurrentLevel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("While reading %v: %w", b.name(), err))
+			continue
+		}
+		fullLevel := b.getLastFullLevel()
+		// energy is proportional to the level, so the voltage is only read once
+		perLevel, err := b.energy(1)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("While reading the voltage of %v: %w", b.name(), err))
+			continue
+		}
+		now += level * perLevel
+		full += fullLevel * perLevel
+		part := b.readStatus()
+		part.charge = level / fullLevel
+		result.parts = append(result.parts, *part)
+		if result.thresholds.End == nil {
+			result.thresholds = part.thresholds
+		}
+	}
+	if full == 0 {
+		return nil, errors.Join(append(errs, errors.New("no battery could be read"))...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		logger.Warn("Leaving out batteries which could not be read", zap.Error(err))
+	}
+	result.charge = now / full
+	result.state = combinedState(result.parts)
+	result.telemetry.Power = combinedPower(result.parts)
+	capacity := full * 1e-6 // from µWh to Wh
+	result.telemetry.Capacity = &capacity
+	return result, nil
+}
+
+// combinedPower is the total power flowing through all batteries,
+// if it is known for each of them.
+func combinedPower(parts []Status) *float64 {
+	var total float64
+	for _, part := range parts {
+		if part.telemetry.Power == nil {
+			return nil
+		}
+		total += *part.telemetry.Power
+	}
+	return &total
+}
@@ -0,0 +1,168 @@
+package power_sources
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Peripheral is the battery of a device such as a wireless mouse,
+// keyboard or headset. These usually report only their capacity as
+// a percentage, or even just a level such as "Low".
+type Peripheral struct {
+	Name          string // e.g. hidpp_battery_0
+	Model         string // e.g. "MX Master 3"
+	Manufacturer  string
+	Charge        *float64 // nil if only the capacity level is known
+	CapacityLevel string   // e.g. "Normal", "Low", "Critical"
+	State         string
+}
+
+func (p Peripheral) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", p.Name)
+	addStrings(enc, map[string]string{
+		"model":          p.Model,
+		"manufacturer":   p.Manufacturer,
+		"capacity level": p.CapacityLevel,
+		"state":          p.State,
+	})
+	if p.Charge != nil {
+		enc.AddFloat64("charge", *p.Charge)
+	}
+	return nil
+}
+
+// Label names the peripheral after its model, if it is known.
+func (p Peripheral) Label() string {
+	if p.Model != "" {
+		return p.Model
+	}
+	return p.Name
+}
+
+// Low is true if the peripheral's charge is below the given
+// fraction, or if it reports its level as low.
+func (p Peripheral) Low(below float64) bool {
+	if p.Charge != nil {
+		return *p.Charge < below
+	}
+	return p.CapacityLevel == "Low" || p.CapacityLevel == "Critical"
+}
+
+func (p Peripheral) String() string {
+	if p.Charge != nil {
+		return fmt.Sprintf("%v %.0f%%", p.Label(), *p.Charge*100)
+	}
+	return fmt.Sprintf("%v %v", p.Label(), p.CapacityLevel)
+}
+
+type peripherals []Peripheral
+
+func (p peripherals) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, peripheral := range p {
+		if err := enc.AppendObject(peripheral); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPeripheral distinguishes device batteries from the system's own.
+// The kernel marks those belonging to devices with a "Device" scope.
+func isPeripheral(path string) bool {
+	return readAttribute(path, "type") == "Battery" && readAttribute(path, "scope") == "Device"
+}
+
+func readPeripheral(path string) Peripheral {
+	result := Peripheral{
+		Name:          filepath.Base(path),
+		Model:         readAttribute(path, "model_name"),
+		Manufacturer:  readAttribute(path, "manufacturer"),
+		CapacityLevel: readAttribute(path, "capacity_level"),
+		State:         readAttribute(path, "status"),
+	}
+	if capacity, err := strconv.ParseFloat(readAttribute(path, "capacity"), 64); err == nil {
+		charge := capacity / 100
+		result.Charge = &charge
+	}
+	return result
+}
+
+// FindPeripherals returns the batteries of any devices currently connected.
+func FindPeripherals() []Peripheral {
+	return findPeripherals(isPeripheral)
+}
+
+func findPeripherals(accept func(path string) bool) []Peripheral {
+	var result []Peripheral
+	for _, path := range Must(filepath.Glob(filepath.Join(powerSupplyDir, "*"))) {
+		if accept(path) {
+			result = append(result, readPeripheral(path))
+		}
+	}
+	return result
+}
+
+// withPeripherals adds the state of any peripherals to each status.
+type withPeripherals struct {
+	PowerSource
+	include []string // names of batteries to report even without a "Device" scope
+	exclude []string // names of batteries never to report
+}
+
+type PeripheralOption func(*withPeripherals)
+
+// IncludePeripherals reports the named batteries (e.g. hidpp_battery_0)
+// as peripherals, for drivers which do not give them a "Device" scope.
+func IncludePeripherals(names ...string) PeripheralOption {
+	return func(w *withPeripherals) {
+		w.include = append(w.include, names...)
+	}
+}
+
+// ExcludePeripherals ignores the named batteries. A model name
+// (e.g. "MX Master 3") may be given instead.
+func ExcludePeripherals(names ...string) PeripheralOption {
+	return func(w *withPeripherals) {
+		w.exclude = append(w.exclude, names...)
+	}
+}
+
+// WithPeripherals reports the batteries of any connected devices along
+// with the power source's status. As devices come and go, they are
+// looked for each time.
+func WithPeripherals(p PowerSource, options ...PeripheralOption) PowerSource {
+	result := &withPeripherals{PowerSource: p}
+	for _, option := range options {
+		option(result)
+	}
+	return result
+}
+
+func (w *withPeripherals) accept(path string) bool {
+	name := filepath.Base(path)
+	if slices.Contains(w.exclude, name) || slices.Contains(w.exclude, readAttribute(path, "model_name")) {
+		return false
+	}
+	if slices.Contains(w.include, name) {
+		return readAttribute(path, "type") == "Battery"
+	}
+	return isPeripheral(path)
+}
+
+func (w *withPeripherals) GetStatus(ctx context.Context) (*Status, error) {
+	status, err := w.PowerSource.GetStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status.peripherals = findPeripherals(w.accept)
+	return status, nil
+}
+
+func (w *withPeripherals) Unwrap() PowerSource {
+	return w.PowerSource
+}
@@ -0,0 +1,107 @@
+package power_sources
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PredictiveLevel is how urgently to alert once the battery
+// is expected to be empty within a given time.
+type PredictiveLevel struct {
+	Within   time.Duration `toml:"within"`
+	Priority string        `toml:"priority"` // one of Priorities
+	Title    string        `toml:"title"`
+	Message  string        `toml:"message"` // text/template, rendered against a MessageContext
+	Tags     []string      `toml:"tags"`
+}
+
+func DefaultPredictiveLevels() []PredictiveLevel {
+	return []PredictiveLevel{
+		{Within: 30 * time.Minute, Priority: "high"},
+		{Within: 10 * time.Minute, Priority: "max"},
+	}
+}
+
+// PredictiveAlerter alerts based on how long the battery is expected to
+// last, rather than how charged it is, so a heavy load is reported
+// sooner and an idle machine later. Each level is alerted once per
+// discharge. Whenever there is no estimate of the time to empty, such
+// as while charging, the fallback alerter decides instead.
+type PredictiveAlerter struct {
+	levels   []Rule // most urgent first
+	fallback *RuleAlerter
+	alerted  int // how many of the least urgent levels have been alerted this discharge
+}
+
+func CreatePredictiveAlerter(initialStatus Status, levels []PredictiveLevel, fallback []Rule) (*PredictiveAlerter, error) {
+	if len(levels) == 0 {
+		return nil, fmt.Errorf("predictive: no levels are defined")
+	}
+	sorted := slices.Clone(levels)
+	slices.SortFunc(sorted, func(a, b PredictiveLevel) int {
+		return cmp.Compare(a.Within, b.Within)
+	})
+	result := &PredictiveAlerter{}
+	for i, level := range sorted {
+		if level.Within <= 0 {
+			return nil, fmt.Errorf("predictive[%v].within: %v must be positive", i, level.Within)
+		}
+		rule := Rule{
+			Name:     fmt.Sprintf("empty-within-%v", FormatDuration(level.Within)),
+			When:     Condition{EmptyWithin: level.Within},
+			Priority: level.Priority,
+			Title:    level.Title,
+			Message:  level.Message,
+			Tags:     level.Tags,
+		}
+		if err := rule.Compile(); err != nil {
+			return nil, fmt.Errorf("predictive[%v].%w", i, err)
+		}
+		result.levels = append(result.levels, rule)
+	}
+	var err error
+	if result.fallback, err = CreateRuleAlerter(initialStatus, fallback); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// level returns the index of the most urgent level the status falls
+// within, or len(levels) if it is not within any of them.
+func (a PredictiveAlerter) level(status *Status) int {
+	for i, rule := range a.levels {
+		if rule.When.Matches(status, status) {
+			return i
+		}
+	}
+	return len(a.levels)
+}
+
+// Evaluate returns the alert to send for the new status, if any.
+// Once the battery starts charging, the levels are rearmed
+// for the next discharge.
+func (a *PredictiveAlerter) Evaluate(logger *zap.Logger, newStatus *Status) (Alert, bool) {
+	if externalPower(newStatus.state) {
+		a.alerted = 0
+	}
+	if _, ok := newStatus.TimeToEmpty(); !ok {
+		return a.fallback.Evaluate(logger, newStatus)
+	}
+	level := a.level(newStatus)
+	if level >= len(a.levels)-a.alerted {
+		// not urgent, or no more urgent than what has already been alerted
+		return Alert{}, false
+	}
+	return a.levels[level].render(logger, newStatus, &a.fallback.lastStatus), true
+}
+
+func (a *PredictiveAlerter) Alerted(status Status) {
+	a.fallback.Alerted(status)
+	if _, ok := status.TimeToEmpty(); ok {
+		a.alerted = len(a.levels) - a.level(&status)
+	}
+}
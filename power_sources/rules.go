@@ -0,0 +1,305 @@
+package power_sources
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Priorities are the alert priorities understood by ntfy,
+// from least to most urgent.
+var Priorities = []string{"min", "low", "default", "high", "max"}
+
+// Condition describes when a Rule matches. Every condition which
+// is set must hold; a Condition with nothing set always matches.
+// "last" refers to the status which was most recently alerted about.
+type Condition struct {
+	ChargeBelow     *float64      `toml:"charge_below"`      // charge < this
+	ChargeAbove     *float64      `toml:"charge_above"`      // charge > this
+	ChargeAtLeast   *float64      `toml:"charge_at_least"`   // charge >= this
+	LastChargeBelow *float64      `toml:"last_charge_below"` // last charge < this
+	StateEquals     string        `toml:"state_equals"`      // e.g. "Discharging"
+	StateChanged    *bool         `toml:"state_changed"`     // whether the state differs from last
+	DropFactor      *float64      `toml:"drop_factor"`       // charge * this <= last charge
+	RisenBy         *float64      `toml:"risen_by"`          // charge >= last charge + this
+	Elapsed         time.Duration `toml:"elapsed"`           // at least this long since last
+	EmptyWithin     time.Duration `toml:"empty_within"`      // expected to be empty within this long
+	FullWithin      time.Duration `toml:"full_within"`       // expected to be full within this long
+}
+
+func (c Condition) Matches(newStatus, last *Status) bool {
+	if c.ChargeBelow != nil && !(newStatus.charge < *c.ChargeBelow) {
+		return false
+	}
+	if c.ChargeAbove != nil && !(newStatus.charge > *c.ChargeAbove) {
+		return false
+	}
+	if c.ChargeAtLeast != nil && !(newStatus.charge >= *c.ChargeAtLeast) {
+		return false
+	}
+	if c.LastChargeBelow != nil && !(last.charge < *c.LastChargeBelow) {
+		return false
+	}
+	if c.StateEquals != "" && newStatus.state != c.StateEquals {
+		return false
+	}
+	if c.StateChanged != nil && (newStatus.state != last.state) != *c.StateChanged {
+		return false
+	}
+	if c.DropFactor != nil && !(newStatus.charge**c.DropFactor <= last.charge) {
+		return false
+	}
+	if c.RisenBy != nil && !(newStatus.charge >= last.charge+*c.RisenBy) {
+		return false
+	}
+	if c.Elapsed > 0 && newStatus.timestamp.Sub(last.timestamp) < c.Elapsed {
+		return false
+	}
+	if c.EmptyWithin > 0 {
+		if remaining, ok := newStatus.TimeToEmpty(); !ok || remaining > c.EmptyWithin {
+			return false
+		}
+	}
+	if c.FullWithin > 0 {
+		if remaining, ok := newStatus.TimeToFull(); !ok || remaining > c.FullWithin {
+			return false
+		}
+	}
+	return true
+}
+
+// Rule is evaluated against each new status. The first matching
+// rule decides whether to alert, and how.
+type Rule struct {
+	Name     string    `toml:"name"`
+	When     Condition `toml:"when"`
+	Suppress bool      `toml:"suppress"` // when matched, don't alert (and stop evaluating rules)
+	Priority string    `toml:"priority"` // one of Priorities
+	Title    string    `toml:"title"`
+	Message  string    `toml:"message"` // text/template, rendered against a MessageContext
+	Tags     []string  `toml:"tags"`
+
+	template *template.Template
+}
+
+// MessageContext is what a Rule's message template is rendered against.
+type MessageContext struct {
+	Status      Status
+	Last        Status
+	Rule        string
+	Priority    string
+	TimeToEmpty string // e.g. "2h15m", or empty if there is no estimate
+	TimeToFull  string
+}
+
+func NewMessageContext(newStatus, last Status, rule, priority string) MessageContext {
+	result := MessageContext{Status: newStatus, Last: last, Rule: rule, Priority: priority}
+	if remaining, ok := newStatus.TimeToEmpty(); ok {
+		result.TimeToEmpty = FormatDuration(remaining)
+	}
+	if remaining, ok := newStatus.TimeToFull(); ok {
+		result.TimeToFull = FormatDuration(remaining)
+	}
+	return result
+}
+
+// DefaultMessage is used by rules which don't specify a message.
+const DefaultMessage = "{{.Status}}" +
+	"{{with .TimeToEmpty}}, {{.}} remaining{{end}}" +
+	"{{with .TimeToFull}}, full in {{.}}{{end}}"
+
+var templateFuncs = template.FuncMap{
+	"percent": func(fraction float64) string {
+		return fmt.Sprintf("%.0f%%", fraction*100)
+	},
+}
+
+// Compile validates the rule, preparing its message template.
+func (r *Rule) Compile() error {
+	if !r.Suppress && !slices.Contains(Priorities, r.Priority) {
+		return fmt.Errorf("priority: %q is not one of %v", r.Priority, Priorities)
+	}
+	message := r.Message
+	if message == "" {
+		message = DefaultMessage
+	}
+	t, err := template.New(r.Name).Funcs(templateFuncs).Parse(message)
+	if err != nil {
+		return fmt.Errorf("message: %w", err)
+	}
+	r.template = t
+	return nil
+}
+
+// Alert is the outcome of a rule matching.
+type Alert struct {
+	Rule     string
+	Priority string
+	Title    string
+	Message  string
+	Tags     []string
+}
+
+// render produces the alert for a compiled rule. If the message
+// template fails, the status itself is used as the message.
+func (r Rule) render(logger *zap.Logger, newStatus, last *Status) Alert {
+	buf := new(bytes.Buffer)
+	context := NewMessageContext(*newStatus, *last, r.Name, r.Priority)
+	if err := r.template.Execute(buf, context); err != nil {
+		logger.Warn("could not render message", zap.String("rule", r.Name), zap.Error(err))
+		buf.Reset()
+		buf.WriteString(newStatus.String())
+	}
+	return Alert{Rule: r.Name, Priority: r.Priority, Title: r.Title, Message: buf.String(), Tags: r.Tags}
+}
+
+type RuleAlerter struct {
+	lastStatus Status
+	rules      []Rule
+}
+
+// CreateRuleAlerter returns an alerter which will compare new statuses
+// against initialStatus until it is told something has been alerted.
+func CreateRuleAlerter(initialStatus Status, rules []Rule) (*RuleAlerter, error) {
+	compiled := slices.Clone(rules)
+	for i := range compiled {
+		if err := compiled[i].Compile(); err != nil {
+			return nil, fmt.Errorf("rules[%v].%w", i, err)
+		}
+	}
+	return &RuleAlerter{lastStatus: initialStatus, rules: compiled}, nil
+}
+
+// Evaluate returns the alert to send for the new status, if any.
+func (a RuleAlerter) Evaluate(logger *zap.Logger, newStatus *Status) (Alert, bool) {
+	logger.Debug("checking", zap.Object("new", *newStatus), zap.Object("previous", a.lastStatus))
+	for _, rule := range a.rules {
+		if !rule.When.Matches(newStatus, &a.lastStatus) {
+			continue
+		}
+		logger.Debug("matched rule", zap.String("rule", rule.Name), zap.Bool("suppress", rule.Suppress))
+		if rule.Suppress {
+			return Alert{}, false
+		}
+		return rule.render(logger, newStatus, &a.lastStatus), true
+	}
+	return Alert{}, false
+}
+
+func (a *RuleAlerter) Alerted(status Status) {
+	a.lastStatus = status
+}
+
+// Thresholds parameterise DefaultRules, deciding when a status
+// is worth alerting about. Charges are fractions between 0 and 1.
+type Thresholds struct {
+	Max        float64       `toml:"max"`         // discharging below this alerts with "max" priority
+	High       float64       `toml:"high"`        // ... "high" priority
+	Default    float64       `toml:"default"`     // ... "default" priority
+	Low        float64       `toml:"low"`         // ... "low" priority
+	Full       float64       `toml:"full"`        // charging beyond this is announced
+	DropFactor float64       `toml:"drop_factor"` // how much the charge must drop by (as a ratio) before alerting again
+	Rise       float64       `toml:"rise"`        // how much the charge must rise by before alerting again
+	Reminder   time.Duration `toml:"reminder"`    // how often to remind about a full battery
+}
+
+func DefaultThresholds() Thresholds {
+	return Thresholds{
+		Max:        0.40,
+		High:       0.45,
+		Default:    0.50,
+		Low:        0.60,
+		Full:       0.80,
+		DropFactor: 1.05,
+		Rise:       0.1,
+		Reminder:   4 * time.Hour,
+	}
+}
+
+// Validate returns an error naming the first
+// threshold which does not make sense.
+func (t Thresholds) Validate() error {
+	ordered := []struct {
+		name  string
+		value float64
+	}{
+		{"max", t.Max},
+		{"high", t.High},
+		{"default", t.Default},
+		{"low", t.Low},
+		{"full", t.Full},
+	}
+	for i, threshold := range ordered {
+		if threshold.value < 0 || threshold.value > 1 {
+			return fmt.Errorf("%v: %v is not between 0 and 1", threshold.name, threshold.value)
+		}
+		if i > 0 && threshold.value < ordered[i-1].value {
+			return fmt.Errorf("%v: %v is less than %v (%v)", threshold.name, threshold.value, ordered[i-1].name, ordered[i-1].value)
+		}
+	}
+	if t.DropFactor < 1 {
+		return fmt.Errorf("drop_factor: %v is less than 1", t.DropFactor)
+	}
+	if t.Rise <= 0 {
+		return fmt.Errorf("rise: %v must be positive", t.Rise)
+	}
+	if t.Reminder <= 0 {
+		return fmt.Errorf("reminder: %v must be positive", t.Reminder)
+	}
+	return nil
+}
+
+// DefaultRules are used when no rules are configured. They alert
+// with increasing urgency as the battery drains, and when
+// it has charged enough to be unplugged.
+func DefaultRules(t Thresholds) []Rule {
+	no, zero := false, 0.0
+	rules := []Rule{
+		{
+			Name:     "steady",
+			When:     Condition{StateChanged: &no, RisenBy: &zero, ChargeBelow: &t.Full},
+			Suppress: true,
+		},
+	}
+	for _, level := range []struct {
+		below    float64
+		priority string
+	}{
+		{t.Max, "max"},
+		{t.High, "high"},
+		{t.Default, "default"},
+		{t.Low, "low"},
+	} {
+		rules = append(rules, Rule{
+			Name:     "draining-" + level.priority,
+			When:     Condition{DropFactor: &t.DropFactor, ChargeBelow: &level.below},
+			Priority: level.priority,
+		})
+	}
+	return append(rules,
+		Rule{
+			Name:     "draining",
+			When:     Condition{DropFactor: &t.DropFactor, ChargeBelow: &t.Full},
+			Suppress: true,
+		},
+		Rule{
+			Name:     "charging",
+			When:     Condition{RisenBy: &t.Rise},
+			Priority: "min",
+		},
+		Rule{
+			Name:     "charged",
+			When:     Condition{ChargeAtLeast: &t.Full, LastChargeBelow: &t.Full},
+			Priority: "default",
+		},
+		Rule{
+			Name:     "reminder",
+			When:     Condition{Elapsed: t.Reminder, ChargeAbove: &t.Full},
+			Priority: "default",
+		},
+	)
+}
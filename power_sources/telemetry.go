@@ -0,0 +1,193 @@
+package power_sources
+
+import (
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Telemetry holds optional details about a battery.
+// A nil field means the value is not available.
+type Telemetry struct {
+	Power         *float64 // W, always positive; State says which direction it flows
+	Voltage       *float64 // V
+	Temperature   *float64 // °C
+	CycleCount    *int
+	Health        *float64 // full capacity as a fraction of the design capacity
+	Capacity      *float64 // Wh corresponding to a charge of 1
+	CapacityLevel string   // e.g. "Normal", "Low", "Critical"
+	Technology    string   // e.g. "Li-ion"
+	Manufacturer  string
+	Model         string
+}
+
+func (t Telemetry) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	addFloats(enc, map[string]*float64{
+		"power":       t.Power,
+		"voltage":     t.Voltage,
+		"temperature": t.Temperature,
+		"health":      t.Health,
+		"capacity":    t.Capacity,
+	})
+	if t.CycleCount != nil {
+		enc.AddInt("cycle count", *t.CycleCount)
+	}
+	addStrings(enc, map[string]string{
+		"capacity level": t.CapacityLevel,
+		"technology":     t.Technology,
+		"manufacturer":   t.Manufacturer,
+		"model":          t.Model,
+	})
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// addFloats adds the values which are known, in order of
+// name so that the fields are consistent between log lines.
+func addFloats(enc zapcore.ObjectEncoder, values map[string]*float64) {
+	for _, name := range sortedKeys(values) {
+		if value := values[name]; value != nil {
+			enc.AddFloat64(name, *value)
+		}
+	}
+}
+
+// addStrings adds the values which are not empty, in order of name.
+func addStrings(enc zapcore.ObjectEncoder, values map[string]string) {
+	for _, name := range sortedKeys(values) {
+		if value := values[name]; value != "" {
+			enc.AddString(name, value)
+		}
+	}
+}
+
+func (b battery) readString(name string) string {
+	byteValue, err := os.ReadFile(filepath.Join(b.path, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(byteValue))
+}
+
+// optional returns a pointer to the scaled value of the named
+// sysfs attribute, or nil if it cannot be read.
+func (b battery) optional(name string, scale float64) *float64 {
+	value, err := b.readFloat(name)
+	if err != nil {
+		return nil
+	}
+	value *= scale
+	return &value
+}
+
+// getTelemetry reads whatever extra details sysfs provides. Values
+// there are in µW, µV, µA and tenths of a degree.
+func (b battery) getTelemetry() Telemetry {
+	result := Telemetry{
+		Voltage:       b.optional("voltage_now", 1e-6),
+		Temperature:   b.optional("temp", 0.1),
+		CapacityLevel: b.readString("capacity_level"),
+		Technology:    b.readString("technology"),
+		Manufacturer:  b.readString("manufacturer"),
+		Model:         b.readString("model_name"),
+	}
+	if power := b.optional("power_now", 1e-6); power != nil {
+		result.Power = power
+	} else if current := b.optional("current_now", 1e-6); current != nil && result.Voltage != nil {
+		power := *current * *result.Voltage
+		result.Power = &power
+	}
+	if result.Power != nil {
+		*result.Power = math.Abs(*result.Power)
+	}
+	if cycles, err := b.readFloat("cycle_count"); err == nil && cycles > 0 {
+		count := int(cycles)
+		result.CycleCount = &count
+	}
+	if capacity, err := b.energy(b.getLastFullLevel()); err == nil {
+		capacity *= 1e-6
+		result.Capacity = &capacity
+	}
+	if full, err := b.readFloat(b.flavour + "_full"); err == nil && b.total > 0 {
+		health := full / b.total
+		result.Health = &health
+	}
+	return result
+}
+
+var ioregProperty = regexp.MustCompile(`"(\w+)" = (\S+)`)
+
+// getMacTelemetry parses the AppleSmartBattery registry entry,
+// which reports mV, mA, mAh and hundredths of a degree.
+func getMacTelemetry() (Telemetry, error) {
+	result := Telemetry{}
+	out, err := exec.Command("/usr/sbin/ioreg", "-rn", "AppleSmartBattery").Output()
+	if err != nil {
+		return result, err
+	}
+	properties := make(map[string]string)
+	for _, match := range ioregProperty.FindAllStringSubmatch(string(out), -1) {
+		if _, exists := properties[match[1]]; !exists {
+			properties[match[1]] = match[2]
+		}
+	}
+	number := func(name string) (float64, bool) {
+		raw, exists := properties[name]
+		if !exists {
+			return 0, false
+		}
+		if value, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return float64(value), true
+		}
+		// negative values are sometimes shown as their unsigned equivalent
+		if value, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			return float64(int64(value)), true
+		}
+		return 0, false
+	}
+	if voltage, ok := number("Voltage"); ok {
+		voltage /= 1000
+		result.Voltage = &voltage
+		if amperage, ok := number("Amperage"); ok {
+			power := math.Abs(voltage * amperage / 1000)
+			result.Power = &power
+		}
+	}
+	if temperature, ok := number("Temperature"); ok {
+		temperature /= 100
+		result.Temperature = &temperature
+	}
+	if cycles, ok := number("CycleCount"); ok {
+		count := int(cycles)
+		result.CycleCount = &count
+	}
+	if full, ok := number("AppleRawMaxCapacity"); ok {
+		if design, ok := number("DesignCapacity"); ok && design > 0 {
+			health := full / design
+			result.Health = &health
+		}
+		// pmset reports the charge relative to the current maximum capacity
+		if result.Voltage != nil {
+			capacity := full * *result.Voltage / 1000
+			result.Capacity = &capacity
+		}
+	}
+	result.Manufacturer = strings.Trim(properties["Manufacturer"], `"`)
+	result.Model = strings.Trim(properties["DeviceName"], `"`)
+	return result, nil
+}
@@ -0,0 +1,161 @@
+package pushover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+const DefaultAPI = "https://api.pushover.net"
+
+// Emergency is Pushover's highest priority, which repeats the
+// notification until it is acknowledged or expires.
+const Emergency = 2
+
+// priorities maps ntfy's priority names onto Pushover's,
+// which range from -2 (no notification) to 2 (emergency).
+var priorities = map[string]int{
+	"min":     -2,
+	"low":     -1,
+	"default": 0,
+	"high":    1,
+	"max":     Emergency,
+}
+
+// Priority returns the Pushover priority corresponding to an ntfy
+// priority name. Unrecognised names are treated as "default".
+func Priority(name string) int {
+	if priority, exists := priorities[name]; exists {
+		return priority
+	}
+	return priorities["default"]
+}
+
+type pushover struct {
+	api    string
+	token  string
+	user   string
+	retry  time.Duration
+	expire time.Duration
+	client *http.Client
+}
+
+type Option func(p *pushover) error
+
+// WithAPI sends to a different API server, such as a local stand-in.
+func WithAPI(api string) Option {
+	return func(p *pushover) error {
+		p.api = strings.TrimSuffix(api, "/")
+		return nil
+	}
+}
+
+// WithEmergency controls how often an emergency notification is
+// repeated (at least every 30 seconds), and for how long (up to 3 hours).
+func WithEmergency(retry, expire time.Duration) Option {
+	return func(p *pushover) error {
+		if retry < 30*time.Second {
+			return fmt.Errorf("retry: %v is less than 30s", retry)
+		}
+		if expire <= 0 || expire > 3*time.Hour {
+			return fmt.Errorf("expire: %v is not between 0 and 3h", expire)
+		}
+		p.retry = retry
+		p.expire = expire
+		return nil
+	}
+}
+
+// WithClient uses the given HTTP client rather than the default one.
+func WithClient(client *http.Client) Option {
+	return func(p *pushover) error {
+		p.client = client
+		return nil
+	}
+}
+
+// response is what Pushover responds with, whether or not
+// the message was accepted.
+type response struct {
+	Status  int      `json:"status"`
+	Request string   `json:"request"`
+	Errors  []string `json:"errors"`
+}
+
+func (p *pushover) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	logger.Info("Sending to Pushover", zap.String("message", message.Text), zap.String("priority", message.Priority))
+	priority := Priority(message.Priority)
+	form := url.Values{
+		"token":    {p.token},
+		"user":     {p.user},
+		"message":  {message.Text},
+		"priority": {strconv.Itoa(priority)},
+	}
+	if message.Title != "" {
+		form.Set("title", message.Title)
+	}
+	if message.Click != "" {
+		form.Set("url", message.Click)
+	}
+	if message.Markdown {
+		// the closest Pushover offers
+		form.Set("html", "1")
+	}
+	if priority == Emergency {
+		form.Set("retry", strconv.Itoa(int(p.retry.Seconds())))
+		form.Set("expire", strconv.Itoa(int(p.expire.Seconds())))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.api+"/1/messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("While trying to write to %v: %w", p.api, err)
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("While reading response from pushover: %w", err)
+	}
+	var decoded response
+	if err := json.Unmarshal(respBytes, &decoded); err != nil {
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("pushover responded with %v: %v", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+		}
+		return fmt.Errorf("While decoding response from pushover: %w", err)
+	}
+	if decoded.Status != 1 || resp.StatusCode >= 400 {
+		return fmt.Errorf("pushover responded with %v: %v (request %v)", resp.StatusCode, strings.Join(decoded.Errors, "; "), decoded.Request)
+	}
+	return nil
+}
+
+// Create returns a sender delivering to a Pushover user
+// (or group) key, using an application token.
+func Create(token, user string, options ...Option) (*pushover, error) {
+	result := &pushover{
+		api:    DefaultAPI,
+		token:  token,
+		user:   user,
+		retry:  time.Minute,
+		expire: time.Hour,
+		client: http.DefaultClient,
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,141 @@
+package pushover
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+func TestPriority(t *testing.T) {
+	for name, expected := range map[string]int{
+		"min":     -2,
+		"low":     -1,
+		"default": 0,
+		"high":    1,
+		"max":     Emergency,
+		"":        0,
+		"unknown": 0,
+	} {
+		if actual := Priority(name); actual != expected {
+			t.Errorf("Priority(%q) = %v, expected %v", name, actual, expected)
+		}
+	}
+}
+
+// fakePushover accepts every message, recording the form it was sent.
+func fakePushover(t *testing.T, received *url.Values) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/1/messages.json" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		*received = r.PostForm
+		w.Write([]byte(`{"status": 1, "request": "647d2300-702c-4b38-8b2f-d56326ae460b"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSend(t *testing.T) {
+	var received url.Values
+	server := fakePushover(t, &received)
+	sender, err := Create("app-token", "user-key", WithAPI(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sender.Send(context.Background(), zap.NewNop(), ntfy.Message{
+		Title:    "Battery low",
+		Text:     "10% [Discharging]",
+		Priority: "high",
+		Click:    "https://example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, expected := range map[string]string{
+		"token":    "app-token",
+		"user":     "user-key",
+		"title":    "Battery low",
+		"message":  "10% [Discharging]",
+		"priority": "1",
+		"url":      "https://example.com",
+	} {
+		if actual := received.Get(field); actual != expected {
+			t.Errorf("%v: got %q, expected %q", field, actual, expected)
+		}
+	}
+	if received.Has("retry") || received.Has("expire") {
+		t.Errorf("retry and expire are only for emergencies: %v", received)
+	}
+}
+
+func TestSendEmergency(t *testing.T) {
+	var received url.Values
+	server := fakePushover(t, &received)
+	sender, err := Create("app-token", "user-key", WithAPI(server.URL), WithEmergency(45*time.Second, 2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.Send(context.Background(), zap.NewNop(), ntfy.Message{Text: "5% [Discharging]", Priority: "max"}); err != nil {
+		t.Fatal(err)
+	}
+	if received.Get("priority") != "2" || received.Get("retry") != "45" || received.Get("expire") != "7200" {
+		t.Errorf("unexpected emergency form %v", received)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	for name, test := range map[string]struct {
+		status   int
+		body     string
+		expected string
+	}{
+		"invalid user": {
+			status:   http.StatusBadRequest,
+			body:     `{"user": "invalid", "errors": ["user identifier is invalid"], "status": 0, "request": "5042853c"}`,
+			expected: "pushover responded with 400: user identifier is invalid (request 5042853c)",
+		},
+		"not JSON": {
+			status:   http.StatusBadGateway,
+			body:     "Bad Gateway\n",
+			expected: "pushover responded with 502: Bad Gateway",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			sender, err := Create("app-token", "wrong", WithAPI(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sender.Send(context.Background(), zap.NewNop(), ntfy.Message{Text: "hello"})
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected an error containing %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestEmergencyLimits(t *testing.T) {
+	for _, test := range []struct{ retry, expire time.Duration }{
+		{10 * time.Second, time.Hour},
+		{time.Minute, 0},
+		{time.Minute, 4 * time.Hour},
+	} {
+		if _, err := Create("app-token", "user-key", WithEmergency(test.retry, test.expire)); err == nil {
+			t.Errorf("expected retry %v and expire %v to be rejected", test.retry, test.expire)
+		}
+	}
+}
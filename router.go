@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"go.uber.org/zap"
+)
+
+// ErrPartiallySent indicates some, but not all, of a Router's
+// senders accepted a message.
+var ErrPartiallySent = errors.New("message was not accepted by every sender")
+
+// Route is a sender, along with which messages it should receive.
+type Route struct {
+	Name        string
+	Sender      Sender
+	MinPriority string        // messages less urgent than this are not sent; empty to send everything
+	Timeout     time.Duration // if positive, how long sending may take
+}
+
+// Accepts is true if the route should receive the message.
+func (r Route) Accepts(message ntfy.Message) bool {
+	if r.MinPriority == "" {
+		return true
+	}
+	return message.PriorityLevel() > slices.Index(ntfy.Priorities, r.MinPriority)
+}
+
+func (r Route) send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	send := func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, r.Sender.Send(ctx, logger, message)
+	}
+	if r.Timeout <= 0 {
+		_, err := send(ctx)
+		return err
+	}
+	_, err := WithTimeout(ctx, r.Timeout, send)
+	return err
+}
+
+// Router is a Sender which passes each message on to
+// every route accepting it, all at once.
+type Router struct {
+	routes []Route
+}
+
+func NewRouter(routes ...Route) *Router {
+	return &Router{routes: routes}
+}
+
+// Send returns nil only if every route accepting the message sent it.
+// If some did (or queued it) but others failed, the error wraps
+// ErrPartiallySent as well as the errors from the others.
+func (r *Router) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(r.routes))
+	for i, route := range r.routes {
+		if !route.Accepts(message) {
+			logger.Debug("not routing message", zap.String("route", route.Name), zap.String("priority", message.Priority))
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := route.send(ctx, logger.With(zap.String("route", route.Name)), message); err != nil {
+				errs[i] = fmt.Errorf("%v: %w", route.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := errors.Join(errs...)
+	if err == nil {
+		return nil
+	}
+	accepted, failed := false, false
+	for i, route := range r.routes {
+		if !route.Accepts(message) {
+			continue
+		}
+		if errs[i] == nil || errors.Is(errs[i], ntfy.ErrQueued) {
+			accepted = true
+		} else {
+			failed = true
+		}
+	}
+	if accepted && failed {
+		return fmt.Errorf("%w: %w", ErrPartiallySent, err)
+	}
+	return err
+}
+
+// Flush sends any queued messages, for routes which queue them.
+func (r *Router) Flush(ctx context.Context, logger *zap.Logger) error {
+	var errs []error
+	for _, route := range r.routes {
+		if flusher, ok := route.Sender.(Flusher); ok {
+			if err := flusher.Flush(ctx, logger); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", route.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
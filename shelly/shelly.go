@@ -0,0 +1,126 @@
+package shelly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// shelly is a first generation Shelly relay, such as the Shelly
+// Plug S, controlled using its local HTTP API.
+// See https://shelly-api-docs.shelly.cloud/gen1/#shelly-plug-plugs-relay-0
+type shelly struct {
+	server   string
+	relay    int
+	username string
+	password string
+	client   *http.Client
+}
+
+type Option func(s *shelly) error
+
+// WithRelay selects which relay to switch, for devices with more
+// than one. The first (and default) is 0.
+func WithRelay(relay int) Option {
+	return func(s *shelly) error {
+		if relay < 0 {
+			return fmt.Errorf("relay %v must not be negative", relay)
+		}
+		s.relay = relay
+		return nil
+	}
+}
+
+// WithAuth authenticates, if restricted login is enabled on the device.
+func WithAuth(username, password string) Option {
+	return func(s *shelly) error {
+		s.username = username
+		s.password = password
+		return nil
+	}
+}
+
+// WithClient uses the given HTTP client rather than the default
+// one, which gives up on a device after 10 seconds.
+func WithClient(client *http.Client) Option {
+	return func(s *shelly) error {
+		s.client = client
+		return nil
+	}
+}
+
+func (s *shelly) String() string {
+	return fmt.Sprintf("%v relay %v", s.server, s.relay)
+}
+
+type relayStatus struct {
+	IsOn bool `json:"ison"`
+}
+
+// request returns whether the relay is on, having applied the query.
+func (s *shelly) request(ctx context.Context, query url.Values) (bool, error) {
+	u := fmt.Sprintf("%v/relay/%v", s.server, s.relay)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("While trying to reach %v: %w", s.server, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("While reading response from Shelly: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("Shelly responded with %v: %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var status relayStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return false, fmt.Errorf("While decoding response from Shelly: %w", err)
+	}
+	return status.IsOn, nil
+}
+
+func (s *shelly) Set(ctx context.Context, on bool) error {
+	turn := "off"
+	if on {
+		turn = "on"
+	}
+	isOn, err := s.request(ctx, url.Values{"turn": {turn}})
+	if err != nil {
+		return err
+	}
+	if isOn != on {
+		return fmt.Errorf("%v did not turn %v", s, turn)
+	}
+	return nil
+}
+
+func (s *shelly) IsOn(ctx context.Context) (bool, error) {
+	return s.request(ctx, nil)
+}
+
+// Create returns a switch for the device at the given
+// address, such as http://192.168.1.50
+func Create(server string, options ...Option) (*shelly, error) {
+	result := &shelly{server: strings.TrimSuffix(server, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,110 @@
+package shelly
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakePlug is a stand-in for a Shelly's relay endpoint.
+func fakePlug(t *testing.T, relay int) *httptest.Server {
+	on := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != fmt.Sprintf("/relay/%v", relay) {
+			http.NotFound(w, r)
+			return
+		}
+		if username, password, _ := r.BasicAuth(); username != "admin" || password != "secret" {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("turn") {
+		case "on":
+			on = true
+		case "off":
+			on = false
+		case "":
+		default:
+			http.Error(w, "Bad turn!", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"ison": %v, "has_timer": false, "timer_duration": 0, "overpower": false}`, on)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSwitching(t *testing.T) {
+	ctx := context.Background()
+	server := fakePlug(t, 1)
+	plug, err := Create(server.URL+"/", WithRelay(1), WithAuth("admin", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, on := range []bool{true, false, true} {
+		if err := plug.Set(ctx, on); err != nil {
+			t.Fatal(err)
+		}
+		isOn, err := plug.IsOn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isOn != on {
+			t.Errorf("plug is %v after turning it %v", isOn, on)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	server := fakePlug(t, 0)
+
+	unauthorised, err := Create(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthorised.IsOn(ctx); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+
+	missing, err := Create(server.URL, WithRelay(3), WithAuth("admin", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := missing.Set(ctx, true); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+
+	garbled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ison": tru`))
+	}))
+	defer garbled.Close()
+	plug, err := Create(garbled.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plug.IsOn(ctx); err == nil || !strings.Contains(err.Error(), "decoding") {
+		t.Errorf("expected a decoding error, got %v", err)
+	}
+
+	if _, err := Create(server.URL, WithRelay(-1)); err == nil {
+		t.Error("expected a negative relay to be rejected")
+	}
+}
+
+func TestStuckRelay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ison": false}`))
+	}))
+	defer server.Close()
+	plug, err := Create(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plug.Set(context.Background(), true); err == nil || !strings.Contains(err.Error(), "did not turn on") {
+		t.Errorf("expected an error, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nicois/battery_monitor/jsonfile"
+	"github.com/nicois/battery_monitor/power_sources"
+	"go.uber.org/zap"
+)
+
+// State is what is remembered between runs.
+type State struct {
+	SavedAt       time.Time             `json:"saved_at"`
+	LastAlerted   *power_sources.Status `json:"last_alerted,omitempty"`
+	HomeAssistant *HaSnapshot           `json:"home_assistant,omitempty"`
+}
+
+type StateConfig struct {
+	File   string        `toml:"file"`    // defaults to $XDG_STATE_HOME/battery_monitor/state.json
+	MaxAge time.Duration `toml:"max_age"` // saved state older than this is disregarded
+}
+
+type StateStore struct {
+	filename string
+	maxAge   time.Duration
+}
+
+func NewStateStore(config StateConfig) *StateStore {
+	return &StateStore{filename: config.filename(), maxAge: config.MaxAge}
+}
+
+func (c StateConfig) filename() string {
+	if c.File == "" {
+		return defaultStateFilename()
+	}
+	return c.File
+}
+
+// travelFilename is where travel mode is recorded, alongside
+// the state file. It is kept separately, as it is written
+// while the monitor is running.
+func (c StateConfig) travelFilename() string {
+	return filepath.Join(filepath.Dir(c.filename()), "travel.json")
+}
+
+func defaultStateFilename() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "battery_monitor.json"
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "battery_monitor", "state.json")
+}
+
+// Load returns the saved state. If there is none, or it is
+// too old to be trusted, an empty state is returned.
+func (s *StateStore) Load() (State, error) {
+	state, err := LoadJSON[State](s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return State{}, nil
+		}
+		return State{}, err
+	}
+	if age := time.Since(state.SavedAt); age > s.maxAge {
+		logger.Info(
+			"disregarding stale state",
+			zap.String("filename", s.filename),
+			zap.Duration("age", age),
+		)
+		return State{}, nil
+	}
+	return state, nil
+}
+
+// Save writes the state via a temporary file, so an interrupted
+// write cannot leave a truncated file behind.
+func (s *StateStore) Save(state State) error {
+	state.SavedAt = time.Now()
+	return jsonfile.Save(s.filename, state)
+}
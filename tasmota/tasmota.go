@@ -0,0 +1,141 @@
+package tasmota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tasmota is a plug running Tasmota, controlled by sending
+// commands to its local HTTP API.
+// See https://tasmota.github.io/docs/Commands/#with-web-requests
+type tasmota struct {
+	server   string
+	relay    int // 0 means the only one
+	username string
+	password string
+	client   *http.Client
+}
+
+type Option func(t *tasmota) error
+
+// WithRelay selects which relay to switch, for devices with
+// more than one. They are numbered from 1.
+func WithRelay(relay int) Option {
+	return func(t *tasmota) error {
+		if relay < 1 {
+			return fmt.Errorf("relay %v must be at least 1", relay)
+		}
+		t.relay = relay
+		return nil
+	}
+}
+
+// WithAuth authenticates, if a web password is set on the device.
+func WithAuth(username, password string) Option {
+	return func(t *tasmota) error {
+		t.username = username
+		t.password = password
+		return nil
+	}
+}
+
+// WithClient uses the given HTTP client rather than the default
+// one, which gives up on a device after 10 seconds.
+func WithClient(client *http.Client) Option {
+	return func(t *tasmota) error {
+		t.client = client
+		return nil
+	}
+}
+
+func (t *tasmota) String() string {
+	return fmt.Sprintf("%v %v", t.server, t.power())
+}
+
+func (t *tasmota) power() string {
+	if t.relay == 0 {
+		return "Power"
+	}
+	return fmt.Sprintf("Power%v", t.relay)
+}
+
+// command returns whether the relay is on, having sent the
+// power command with the given argument (if any).
+func (t *tasmota) command(ctx context.Context, argument string) (bool, error) {
+	command := t.power()
+	if argument != "" {
+		command += " " + argument
+	}
+	query := url.Values{"cmnd": {command}}
+	if t.username != "" {
+		query.Set("user", t.username)
+		query.Set("password", t.password)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", t.server+"/cm?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("While trying to reach %v: %w", t.server, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("While reading response from Tasmota: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return false, fmt.Errorf("Tasmota responded with %v: %v", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	// e.g. {"POWER":"ON"}, or {"WARNING":"Need user=<username>&password=<password>"}
+	var result map[string]string
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, fmt.Errorf("While decoding response from Tasmota: %w", err)
+	}
+	state, exists := result[strings.ToUpper(t.power())]
+	if !exists && t.relay == 1 {
+		// devices with a single relay don't number it
+		state, exists = result["POWER"]
+	}
+	if !exists {
+		return false, fmt.Errorf("unexpected response from Tasmota: %v", strings.TrimSpace(string(body)))
+	}
+	return state == "ON", nil
+}
+
+func (t *tasmota) Set(ctx context.Context, on bool) error {
+	argument := "Off"
+	if on {
+		argument = "On"
+	}
+	isOn, err := t.command(ctx, argument)
+	if err != nil {
+		return err
+	}
+	if isOn != on {
+		return fmt.Errorf("%v did not turn %v", t, strings.ToLower(argument))
+	}
+	return nil
+}
+
+func (t *tasmota) IsOn(ctx context.Context) (bool, error) {
+	return t.command(ctx, "")
+}
+
+// Create returns a switch for the device at the given
+// address, such as http://192.168.1.51
+func Create(server string, options ...Option) (*tasmota, error) {
+	result := &tasmota{server: strings.TrimSuffix(server, "/"), client: &http.Client{Timeout: 10 * time.Second}}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package tasmota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakePlug is a stand-in for a Tasmota device with the given number
+// of relays. Like the real thing, a single relay is called POWER,
+// and several are called POWER1, POWER2 and so on.
+func fakePlug(t *testing.T, relays int) *httptest.Server {
+	states := make([]string, relays+1)
+	for i := range states {
+		states[i] = "OFF"
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cm" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("user") != "admin" || query.Get("password") != "secret" {
+			fmt.Fprint(w, `{"WARNING":"Need user=<username>&password=<password>"}`)
+			return
+		}
+		command, argument, _ := strings.Cut(query.Get("cmnd"), " ")
+		relay := 1
+		if number := strings.TrimPrefix(command, "Power"); number != "" {
+			fmt.Sscan(number, &relay)
+		}
+		if relay > relays {
+			fmt.Fprint(w, `{"Command":"Unknown"}`)
+			return
+		}
+		switch argument {
+		case "On":
+			states[relay] = "ON"
+		case "Off":
+			states[relay] = "OFF"
+		}
+		name := "POWER"
+		if relays > 1 {
+			name = fmt.Sprintf("POWER%v", relay)
+		}
+		fmt.Fprintf(w, `{%q:%q}`, name, states[relay])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSwitching(t *testing.T) {
+	ctx := context.Background()
+	for name, test := range map[string]struct {
+		relays  int
+		options []Option
+	}{
+		"single relay":          {relays: 1},
+		"single relay numbered": {relays: 1, options: []Option{WithRelay(1)}},
+		"second of several":     {relays: 4, options: []Option{WithRelay(2)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := fakePlug(t, test.relays)
+			plug, err := Create(server.URL+"/", append(test.options, WithAuth("admin", "secret"))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, on := range []bool{true, false, true} {
+				if err := plug.Set(ctx, on); err != nil {
+					t.Fatal(err)
+				}
+				isOn, err := plug.IsOn(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if isOn != on {
+					t.Errorf("plug is %v after turning it %v", isOn, on)
+				}
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	server := fakePlug(t, 1)
+
+	unauthorised, err := Create(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthorised.IsOn(ctx); err == nil || !strings.Contains(err.Error(), "WARNING") {
+		t.Errorf("expected the warning to be reported, got %v", err)
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"server error": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		},
+		"malformed JSON": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"POWER":`))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			broken := httptest.NewServer(handler)
+			defer broken.Close()
+			plug, err := Create(broken.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := plug.Set(ctx, true); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	if _, err := Create(server.URL, WithRelay(0)); err == nil {
+		t.Error("expected relay 0 to be rejected")
+	}
+}
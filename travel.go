@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicois/battery_monitor/jsonfile"
+	"github.com/nicois/battery_monitor/power_sources"
+)
+
+// Travel is recorded while travel mode is on, so the usual
+// thresholds can be restored once the battery is full.
+type Travel struct {
+	Since   time.Time                      `json:"since"`
+	Restore power_sources.ChargeThresholds `json:"restore"`
+}
+
+// chargeControl returns the battery's firmware charge control, if any.
+func chargeControl(p power_sources.PowerSource) (power_sources.ChargeControl, error) {
+	if control, ok := power_sources.ChargeControlOf(p); ok {
+		return control, nil
+	}
+	return nil, fmt.Errorf("this battery does not support charge thresholds")
+}
+
+// parseThresholds interprets the arguments of set-thresholds, which are
+// percentages: either the end threshold alone, or the start and end.
+func parseThresholds(args []string) (power_sources.ChargeThresholds, error) {
+	var result power_sources.ChargeThresholds
+	if len(args) < 1 || len(args) > 2 {
+		return result, fmt.Errorf("usage: set-thresholds [START] END")
+	}
+	thresholds := make([]*float64, len(args))
+	for i, arg := range args {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+		if err != nil {
+			return result, fmt.Errorf("%q is not a percentage", arg)
+		}
+		threshold := percent / 100
+		thresholds[i] = &threshold
+	}
+	if len(thresholds) == 2 {
+		result.Start = thresholds[0]
+	}
+	result.End = thresholds[len(thresholds)-1]
+	return result, result.Validate()
+}
+
+// startTravel raises the end threshold to 100% until the battery is
+// next full, remembering the current thresholds so they can be restored.
+// Travel mode is only recorded once the thresholds have been raised, so
+// a failure (such as lacking permission) leaves nothing behind.
+func startTravel(control power_sources.ChargeControl, filename string) error {
+	if travel, err := LoadJSON[Travel](filename); err == nil {
+		return fmt.Errorf("travel mode has been on since %v", travel.Since.Format(time.DateTime))
+	}
+	current, err := control.ChargeThresholds()
+	if err != nil {
+		return err
+	}
+	full := 1.0
+	err = control.SetChargeThresholds(power_sources.ChargeThresholds{End: &full})
+	if err == nil {
+		err = jsonfile.Save(filename, Travel{Since: time.Now(), Restore: current})
+	}
+	if err != nil {
+		// some batteries may have been changed already
+		return errors.Join(err, control.SetChargeThresholds(current))
+	}
+	return nil
+}
+
+// checkNotSudo refuses to record travel mode as root on behalf of
+// another user, as it would go in root's state directory, where
+// that user's monitor won't find it.
+func checkNotSudo() error {
+	if user := os.Getenv("SUDO_USER"); user != "" && os.Geteuid() == 0 {
+		return fmt.Errorf("travel mode would be recorded for root rather than %v; instead of sudo, "+
+			"make the charge_control_*_threshold files writable (e.g. with a udev rule)", user)
+	}
+	return nil
+}
+
+// isFull is true if the battery has charged as much as it can. The
+// charge is relative to what the battery last held when full, so even
+// a worn battery gets there. The state alone is not enough, as a pack
+// reports "Unknown" once one battery is full and the other has stopped.
+func isFull(status *power_sources.Status) bool {
+	return status.State() == "Full" || status.Charge() >= 0.99
+}
+
+// finishTravel restores the usual thresholds, if travel mode is on
+// and the battery is now full. It returns the travel mode which
+// finished, if any.
+func finishTravel(control power_sources.ChargeControl, filename string, status *power_sources.Status) (*Travel, error) {
+	travel, err := LoadJSON[Travel](filename)
+	if os.IsNotExist(err) || (err == nil && !isFull(status)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := control.SetChargeThresholds(travel.Restore); err != nil {
+		return nil, err
+	}
+	return &travel, os.Remove(filename)
+}
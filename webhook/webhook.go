@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nicois/battery_monitor/ntfy"
+	"github.com/nicois/battery_monitor/power_sources"
+	"go.uber.org/zap"
+)
+
+// Context is what each of the webhook's templates are rendered against.
+type Context struct {
+	Text          string
+	Title         string
+	Priority      string // ntfy's name for it, e.g. "high"
+	PriorityLevel int    // 1 (min) to 5 (max)
+	Tags          []string
+	Click         string
+	Hostname      string
+	Time          time.Time
+	// these are only set if the message is about a battery
+	Charge      float64 // a fraction between 0 and 1
+	State       string
+	TimeToEmpty string // e.g. "2h15m", or empty if there is no estimate
+	TimeToFull  string
+}
+
+var templateFuncs = template.FuncMap{
+	// json quotes a value, so it can be safely embedded in a JSON body
+	"json": func(value any) (string, error) {
+		result, err := json.Marshal(value)
+		return string(result), err
+	},
+	"percent": func(fraction float64) string {
+		return fmt.Sprintf("%.0f%%", fraction*100)
+	},
+	"join": strings.Join,
+}
+
+type webhook struct {
+	method   *template.Template
+	url      *template.Template
+	headers  map[string]*template.Template
+	body     *template.Template
+	hostname string
+	client   *http.Client
+}
+
+// Templates for each part of the request. Only URL is required;
+// the method defaults to POST and the body to the message text.
+type Templates struct {
+	Method  string
+	URL     string
+	Headers map[string]string
+	Body    string
+}
+
+type Option func(w *webhook) error
+
+// WithClient uses the given HTTP client rather than the default one.
+func WithClient(client *http.Client) Option {
+	return func(w *webhook) error {
+		w.client = client
+		return nil
+	}
+}
+
+func parse(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, context Context) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, context); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (w *webhook) context(message ntfy.Message) Context {
+	result := Context{
+		Text:          message.Text,
+		Title:         message.Title,
+		Priority:      message.Priority,
+		PriorityLevel: message.PriorityLevel(),
+		Tags:          message.Tags,
+		Click:         message.Click,
+		Hostname:      w.hostname,
+		Time:          time.Now(),
+	}
+	if battery := message.Battery; battery != nil {
+		result.Charge = battery.Charge
+		result.State = battery.State
+		result.Time = battery.Time
+		if remaining := battery.TimeToEmpty; remaining != nil {
+			result.TimeToEmpty = power_sources.FormatDuration(*remaining)
+		}
+		if remaining := battery.TimeToFull; remaining != nil {
+			result.TimeToFull = power_sources.FormatDuration(*remaining)
+		}
+	}
+	return result
+}
+
+func (w *webhook) request(ctx context.Context, message ntfy.Message) (*http.Request, error) {
+	context := w.context(message)
+	method, err := render(w.method, context)
+	if err != nil {
+		return nil, err
+	}
+	url, err := render(w.url, context)
+	if err != nil {
+		return nil, err
+	}
+	body, err := render(w.body, context)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.TrimSpace(method), strings.TrimSpace(url), strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, t := range w.headers {
+		value, err := render(t, context)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+func (w *webhook) Send(ctx context.Context, logger *zap.Logger, message ntfy.Message) error {
+	req, err := w.request(ctx, message)
+	if err != nil {
+		return fmt.Errorf("While rendering webhook: %w", err)
+	}
+	logger.Info("Sending webhook", zap.String("message", message.Text), zap.String("method", req.Method), zap.String("URL", req.URL.Redacted()))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		respBytes, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("While reading response from webhook: %w", err)
+		}
+		return fmt.Errorf("webhook responded with %v: %v", resp.StatusCode, strings.TrimSpace(string(respBytes)))
+	}
+	return nil
+}
+
+// Create returns a sender making an HTTP request built from the templates.
+func Create(templates Templates, options ...Option) (*webhook, error) {
+	if templates.URL == "" {
+		return nil, fmt.Errorf("url: must not be empty")
+	}
+	if templates.Method == "" {
+		templates.Method = "POST"
+	}
+	if templates.Body == "" {
+		templates.Body = "{{.Text}}"
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	result := &webhook{
+		headers:  make(map[string]*template.Template, len(templates.Headers)),
+		hostname: hostname,
+		client:   http.DefaultClient,
+	}
+	if result.method, err = parse("method", templates.Method); err != nil {
+		return nil, err
+	}
+	if result.url, err = parse("url", templates.URL); err != nil {
+		return nil, err
+	}
+	if result.body, err = parse("body", templates.Body); err != nil {
+		return nil, err
+	}
+	for name, text := range templates.Headers {
+		if result.headers[name], err = parse("headers."+name, text); err != nil {
+			return nil, err
+		}
+	}
+	for _, option := range options {
+		if err := option(result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}